@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// authorised checks the request carries the configured api_token. The api
+// shares its listener with the webhooks, which github has to be able to reach,
+// so it's disabled until a token is configured.
+func authorised(w http.ResponseWriter, r *http.Request) bool {
+	c := conf()
+	if isEmpty(c.APIToken) {
+		http.Error(w, "the api requires api_token to be configured", http.StatusForbidden)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.APIToken)) != 1 {
+		http.Error(w, "unauthorised", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type apiError struct {
+	Error      string      `json:"error"`
+	Deployment *deployment `json:"deployment,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write api response: %v", err)
+	}
+}
+
+// handleHistory - GET /api/history?repo=<path|name>&limit=N
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	c := conf()
+	idx, ok := c.LookupRepo(r.URL.Query().Get("repo"))
+	if !ok {
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return
+	}
+
+	var limit int
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	history, err := readHistory(&c.Repos[idx], limit)
+	if err != nil {
+		log.Errorf("Failed to read history: %v", err)
+		http.Error(w, "failed to read history", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+// handleRollback - POST /api/rollback?repo=<path|name>[&to=<sha>|&steps=N]
+func handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	c := conf()
+	idx, ok := c.LookupRepo(r.URL.Query().Get("repo"))
+	if !ok {
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return
+	}
+
+	steps := 1
+	if s := r.URL.Query().Get("steps"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid steps", http.StatusBadRequest)
+			return
+		}
+		steps = n
+	}
+
+	j := newJob(&c.Repos[idx], "rollback")
+	j.to = r.URL.Query().Get("to")
+	j.steps = steps
+	sched.submit(j)
+	<-j.finished
+
+	d, err := j.result, j.err
+	if err == nil && d == nil {
+		err = context.Canceled
+	}
+	if err != nil {
+		writeJSON(w, http.StatusConflict, apiError{Error: err.Error(), Deployment: d})
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// handleUnpin - POST /api/unpin?repo=<path|name>, then queues an update to
+// apply anything pushed while the repo was pinned
+func handleUnpin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	c := conf()
+	idx, ok := c.LookupRepo(r.URL.Query().Get("repo"))
+	if !ok {
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return
+	}
+
+	if err := c.Repos[idx].unpin(); err != nil {
+		log.Errorf("Failed to unpin repo: %v", err)
+		http.Error(w, "failed to unpin", http.StatusInternalServerError)
+		return
+	}
+	// deliveries held while pinned were dropped, catch up with the remote
+	j := newJob(&c.Repos[idx], "update")
+	c.DataPasser.jobs <- j
+	writeJSON(w, http.StatusAccepted, map[string]string{"job": j.id})
+}
+
+// handleCancel - POST /api/cancel?repo=<path|name>
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	c := conf()
+	idx, ok := c.LookupRepo(r.URL.Query().Get("repo"))
+	if !ok {
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return
+	}
+
+	n := sched.cancel(c.Repos[idx].Path)
+	log.WithField("repo", c.Repos[idx].Name()).Warnf("Cancelled %v in-flight jobs", n)
+	writeJSON(w, http.StatusOK, map[string]int{"cancelled": n})
+}
+
+// handleJobs - GET /api/jobs[?repo=<path|name>][&state=<state>]
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	var path string
+	if id := r.URL.Query().Get("repo"); id != "" {
+		c := conf()
+		idx, ok := c.LookupRepo(id)
+		if !ok {
+			http.Error(w, "repository not found", http.StatusNotFound)
+			return
+		}
+		path = c.Repos[idx].Path
+	}
+	writeJSON(w, http.StatusOK, listJobs(path, r.URL.Query().Get("state")))
+}
+
+// handleJob - GET /api/jobs/{id}, ids of folded jobs return the job they were folded into
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	status, ok := lookupJob(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleQueue - GET /api/queue, workers, per host usage and the repos with jobs
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, sched.metrics())
+}
+
+// deadQuery picks dead letters by ?id=, ?repo=<path|name> or ?all=true
+func deadQuery(w http.ResponseWriter, r *http.Request) ([]deadLetter, bool) {
+	q := r.URL.Query()
+	var path string
+	if id := q.Get("repo"); id != "" {
+		c := conf()
+		idx, ok := c.LookupRepo(id)
+		if !ok {
+			http.Error(w, "repository not found", http.StatusNotFound)
+			return nil, false
+		}
+		path = c.Repos[idx].Path
+	}
+	all, _ := strconv.ParseBool(q.Get("all"))
+	list, err := selectDeadLetters(q.Get("id"), path, all)
+	if os.IsNotExist(err) {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return list, true
+}
+
+// handleDead - GET /api/dead[?repo=<path|name>], failed jobs without their payloads
+func handleDead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	var path string
+	if id := r.URL.Query().Get("repo"); id != "" {
+		c := conf()
+		idx, ok := c.LookupRepo(id)
+		if !ok {
+			http.Error(w, "repository not found", http.StatusNotFound)
+			return
+		}
+		path = c.Repos[idx].Path
+	}
+	list, err := readDeadLetters(path)
+	if err != nil {
+		log.Errorf("Failed to read dead letters: %v", err)
+		http.Error(w, "failed to read dead letters", http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		list[i].Payload = nil
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleDeadLetter - GET /api/dead/{id}, a failed job including its payload
+func handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+
+	list, err := selectDeadLetters(strings.TrimPrefix(r.URL.Path, "/api/dead/"), "", false)
+	if os.IsNotExist(err) || len(list) == 0 {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, list[0])
+}
+
+// handleDeadRetry - POST /api/dead/retry?id=<id>|repo=<path|name>|all=true, queues
+// the jobs again and returns the new job ids by dead letter id
+func handleDeadRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+	list, ok := deadQuery(w, r)
+	if !ok {
+		return
+	}
+
+	resp := struct {
+		Retried map[string]string `json:"retried"`
+		Errors  map[string]string `json:"errors,omitempty"`
+	}{Retried: make(map[string]string), Errors: make(map[string]string)}
+	for _, dl := range list {
+		j, err := retryDeadLetter(dl)
+		if err != nil {
+			resp.Errors[dl.ID] = err.Error()
+			continue
+		}
+		resp.Retried[dl.ID] = j.id
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleDeadDiscard - POST /api/dead/discard?id=<id>|repo=<path|name>|all=true
+func handleDeadDiscard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorised(w, r) {
+		return
+	}
+	list, ok := deadQuery(w, r)
+	if !ok {
+		return
+	}
+
+	n := 0
+	for _, dl := range list {
+		if err := discardDeadLetter(dl.ID); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to discard dead letter %v: %v", dl.ID, err)
+			continue
+		}
+		n++
+	}
+	log.Warnf("Discarded %v dead letters", n)
+	writeJSON(w, http.StatusOK, map[string]int{"discarded": n})
+}
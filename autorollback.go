@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// afterDeploy fires the trigger, runs the post update commands for d, signals
+// the service to reload and waits for the health check to pass
+func (r *repo) afterDeploy(ctx context.Context, d *deployment) error {
+	if err := r.touchTrigger(d); err != nil {
+		// the deploy itself worked, watchers just won't hear about it
+		d.TriggerError = err.Error()
+	}
+	if err := r.postUpdate(ctx, d); err != nil {
+		return err
+	}
+	if err := r.reload(d); err != nil {
+		return err
+	}
+	return r.checkHealth(ctx)
+}
+
+// autoRollback puts the previous commit back after the post update steps for
+// d failed with cause, then fires the trigger and runs the post update steps
+// again for it. d ends up rolled-back, or failed if the rollback didn't work.
+func (r *repo) autoRollback(repo *git.Repository, d *deployment, cause error) {
+	rlog := log.WithFields(logrus.Fields{
+		"repo":      r.Name(),
+		"path":      r.Path,
+		"label":     r.Label,
+		"labelType": r.LabelType,
+	})
+	if isEmpty(d.OldSHA) || d.OldSHA == d.NewSHA {
+		rlog.Error("No previous commit to roll back to")
+		return
+	}
+	prev := plumbing.NewHash(d.OldSHA)
+	rlog.Warnf("Post update steps failed (%v), rolling back to %v", cause, prev)
+
+	w, err := repo.Worktree()
+	if err != nil {
+		d.RollbackError = fmt.Sprintf("failed to open work tree for repository: %v", err)
+		rlog.Errorf("Failed to roll back: %v", d.RollbackError)
+		return
+	}
+	if err := w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: prev}); err != nil {
+		d.RollbackError = fmt.Sprintf("failed to hard reset work tree: %v", err)
+		rlog.Errorf("Failed to roll back: %v", d.RollbackError)
+		return
+	}
+	if err := r.deploy(repo, prev); err != nil {
+		d.RollbackError = err.Error()
+		rlog.Errorf("Failed to roll back: %v", err)
+		return
+	}
+
+	// the steps see the rollback as a deployment from the failed commit to the
+	// previous one, and get to finish even if the job was cancelled
+	rd := *d
+	rd.OldSHA, rd.NewSHA, rd.Commands = d.NewSHA, d.OldSHA, nil
+	err = r.afterDeploy(context.Background(), &rd)
+	d.Commands = append(d.Commands, rd.Commands...)
+	d.TriggerError = rd.TriggerError
+	d.rolledBack(prev, err)
+	if err != nil {
+		rlog.Errorf("Rolled back to %v, but its post update steps failed too: %v", prev, err)
+		return
+	}
+	rlog.Warnf("Rolled back to %v", prev)
+}
+
+// rolledBackFrom reports whether the repo's last deployment attempt was
+// automatically rolled back from sha, so it isn't retried until something new is pushed
+func (r *repo) rolledBackFrom(sha string) bool {
+	history, err := readHistory(r, 20)
+	if err != nil {
+		return false
+	}
+	for _, d := range history {
+		switch d.Outcome {
+		case "skipped", "held", "vetoed", "cancelled":
+			continue
+		}
+		return d.Outcome == "rolled-back" && d.NewSHA == sha
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// callback is a url POSTed a json document whenever a job finishes
+type callback struct {
+	URL     string      `mapstructure:"url"`
+	Secret  string      `mapstructure:"secret"`  // signs the body like github does, blank for unsigned
+	Repos   []string    `mapstructure:"repos"`   // repo names or paths, blank for every repo
+	Timeout float64     `mapstructure:"timeout"` // seconds per request, defaults to 10
+	Retry   retryPolicy `mapstructure:"retry"`   // defaults to 5 attempts from 2s, doubling up to 60s
+}
+
+// callbackPayload is the document sent, the job's deployment plus how it ended
+type callbackPayload struct {
+	Job      string  `json:"job"`
+	State    string  `json:"state"`
+	Duration float64 `json:"duration"` // seconds
+	*deployment
+}
+
+// validateCallbacks drops callbacks without a url and fills in defaults
+func (c *config) validateCallbacks() {
+	valid := c.Callbacks[:0]
+	for _, cb := range c.Callbacks {
+		if isEmpty(cb.URL) {
+			log.Error("Callback has no url, ignoring it")
+			continue
+		}
+		if cb.Timeout <= 0 {
+			cb.Timeout = 10
+		}
+		p := &cb.Retry
+		if p.Attempts < 1 {
+			p.Attempts = 5
+		}
+		if p.Delay <= 0 {
+			p.Delay = 2
+		}
+		if p.Multiplier < 1 {
+			p.Multiplier = 2
+		}
+		if p.MaxDelay <= 0 {
+			p.MaxDelay = 60
+		}
+		if p.Jitter < 0 || p.Jitter > 1 {
+			p.Jitter = 0
+		}
+		valid = append(valid, cb)
+	}
+	c.Callbacks = valid
+}
+
+// wants reports whether the callback is interested in the repo
+func (cb *callback) wants(r *repo) bool {
+	if len(cb.Repos) == 0 {
+		return true
+	}
+	for _, id := range cb.Repos {
+		if id == r.Name() || cleanURL(id) == r.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// sendCallbacks delivers the finished job to every interested callback, in
+// the background so the worker can move on
+func (j *job) sendCallbacks(state string) {
+	c := conf()
+	if j.result == nil || len(c.Callbacks) == 0 {
+		// never ran
+		return
+	}
+	var body []byte
+	for i := range c.Callbacks {
+		cb := c.Callbacks[i]
+		if !cb.wants(j.repo) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(callbackPayload{
+				Job:        j.id,
+				State:      state,
+				Duration:   j.result.End.Sub(j.result.Start).Seconds(),
+				deployment: j.result,
+			})
+			if err != nil {
+				log.Errorf("Failed to encode callback for job %v: %v", j.id, err)
+				return
+			}
+		}
+		go cb.deliver(j.repo, body)
+	}
+}
+
+// deliver POSTs body to the callback, retrying with backoff
+func (cb callback) deliver(r *repo, body []byte) {
+	id := newJobID()
+	rlog := log.WithFields(logrus.Fields{
+		"repo":     r.Name(),
+		"callback": cb.URL,
+		"id":       id,
+	})
+	client := &http.Client{Timeout: time.Duration(cb.Timeout * float64(time.Second))}
+	err := cb.Retry.do(context.Background(), rlog, "deliver callback", func() error {
+		return cb.post(client, id, body)
+	})
+	if err == nil {
+		rlog.Info("Delivered callback")
+	}
+}
+
+// post makes a single delivery attempt, client errors other than timeouts and
+// rate limits aren't retried
+func (cb *callback) post(client *http.Client, id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, cb.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gwg")
+	req.Header.Set("X-Gwg-Event", "job")
+	req.Header.Set("X-Gwg-Delivery", id)
+	if cb.Secret != "" {
+		req.Header.Set("X-Hub-Signature", "sha1="+sign(sha1.New, cb.Secret, body))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+sign(sha256.New, cb.Secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("got status %v", resp.StatusCode)
+	}
+	return permanentError{fmt.Errorf("got status %v", resp.StatusCode)}
+}
+
+// sign is the hex encoded hmac of body, as in github's X-Hub-Signature headers
+func sign(h func() hash.Hash, secret string, body []byte) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	// github's example from validating webhook deliveries
+	secret, body := "It's a Secret to Everybody", []byte("Hello, World!")
+	if got, want := sign(sha256.New, secret, body), "757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"; got != want {
+		t.Errorf("sha256: got %v, want %v", got, want)
+	}
+	if got, want := sign(sha1.New, secret, body), "01dc10d0c83e72ed246219cdd91669667fe2ca59"; got != want {
+		t.Errorf("sha1: got %v, want %v", got, want)
+	}
+}
+
+func TestCallbackHeaders(t *testing.T) {
+	body := []byte(`{"job":"1234","state":"succeeded"}`)
+	for _, secret := range []string{"s3cret", ""} {
+		var got *http.Request
+		var gotBody []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r
+			gotBody, _ = ioutil.ReadAll(r.Body)
+		}))
+		cb := &callback{URL: srv.URL, Secret: secret}
+		err := cb.post(srv.Client(), "delivery-1", body)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("secret %q: %v", secret, err)
+		}
+
+		if got.Method != http.MethodPost || string(gotBody) != string(body) {
+			t.Errorf("secret %q: got %v %s, want the body POSTed", secret, got.Method, gotBody)
+		}
+		for k, v := range map[string]string{
+			"Content-Type":   "application/json",
+			"User-Agent":     "gwg",
+			"X-Gwg-Event":    "job",
+			"X-Gwg-Delivery": "delivery-1",
+		} {
+			if got.Header.Get(k) != v {
+				t.Errorf("secret %q: got %v %q, want %q", secret, k, got.Header.Get(k), v)
+			}
+		}
+
+		sig1, sig256 := got.Header.Get("X-Hub-Signature"), got.Header.Get("X-Hub-Signature-256")
+		if secret == "" {
+			if sig1 != "" || sig256 != "" {
+				t.Errorf("unsigned callback got signatures %q and %q", sig1, sig256)
+			}
+			continue
+		}
+		// sign itself is checked against github's example in TestSign
+		if want := "sha256=" + sign(sha256.New, secret, gotBody); sig256 != want {
+			t.Errorf("got X-Hub-Signature-256 %q, want %q", sig256, want)
+		}
+		if want := "sha1=" + sign(sha1.New, secret, gotBody); sig1 != want {
+			t.Errorf("got X-Hub-Signature %q, want %q", sig1, want)
+		}
+	}
+}
+
+func TestCallbackRetries(t *testing.T) {
+	for _, c := range []struct {
+		status   int
+		requests int32
+	}{
+		{http.StatusOK, 1},
+		{http.StatusNoContent, 1},
+		{http.StatusBadRequest, 1},
+		{http.StatusUnauthorized, 1},
+		{http.StatusNotFound, 1},
+		{http.StatusGone, 1},
+		{http.StatusRequestTimeout, 3},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusInternalServerError, 3},
+		{http.StatusServiceUnavailable, 3},
+	} {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(c.status)
+		}))
+		cb := callback{
+			URL:     srv.URL,
+			Timeout: 5,
+			Retry:   retryPolicy{Attempts: 3, Delay: 0.01, Multiplier: 1, MaxDelay: 0.01},
+		}
+		cb.deliver(&repo{URL: "https://example.com/a.git"}, []byte("{}"))
+		srv.Close()
+		if got := atomic.LoadInt32(&requests); got != c.requests {
+			t.Errorf("status %v: got %v requests, want %v", c.status, got, c.requests)
+		}
+	}
+}
+
+func TestCallbackRecovers(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	cb := &callback{URL: srv.URL, Timeout: 5, Retry: retryPolicy{Attempts: 5, Delay: 0.01, Multiplier: 1, MaxDelay: 0.01}}
+	cb.deliver(&repo{URL: "https://example.com/a.git"}, []byte("{}"))
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("got %v requests, want 3", got)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+const usage = `usage: gwg [command]
+
+With no command gwg runs the webhook server.
+
+commands:
+  history <repo> [-n N] [--json]             show the deployment history for a repo (path or name)
+  rollback <repo> [--to <sha>|--steps N]     roll back to an earlier deployment and pin the repo there
+  unpin <repo>                               release a pinned repo and update it, webhook updates apply again
+  cancel <repo>                              cancel the repo's in-flight clone / update
+  queue [--json]                             show workers, per host usage and the repos with jobs
+  dead [list] [--repo <repo>] [--json]       show jobs that failed after all their retries
+  dead retry|discard <id>|--repo <repo>|--all
+                                             queue failed jobs again, or remove them
+`
+
+// runCommand runs a subcommand and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "history":
+		return historyCommand(args[1:])
+	case "rollback":
+		return rollbackCommand(args[1:])
+	case "unpin":
+		return unpinCommand(args[1:])
+	case "cancel":
+		return cancelCommand(args[1:])
+	case "queue":
+		return queueCommand(args[1:])
+	case "dead":
+		return deadCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %v\n\n%v", args[0], usage)
+		return 2
+	}
+}
+
+func newFlagSet(name, use string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gwg "+use)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// lookupArg finds the repo named by the first positional argument
+func lookupArg(fs *flag.FlagSet) (*repo, bool) {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil, false
+	}
+	c := conf()
+	idx, ok := c.LookupRepo(fs.Arg(0))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "repository not found: %v\n", fs.Arg(0))
+		return nil, false
+	}
+	return &c.Repos[idx], true
+}
+
+// apiRequest calls the running server, commands that change a repo go
+// through the server so they can't race with webhook updates.
+func apiRequest(method, endpoint string, params url.Values) ([]byte, error) {
+	c := conf()
+	host := c.Listen
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	u := "http://" + net.JoinHostPort(host, c.Port) + endpoint + "?" + params.Encode()
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach gwg, is it running? %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return body, fmt.Errorf("%v: %s", resp.Status, body)
+	}
+	return body, nil
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+func historyCommand(args []string) int {
+	fs := newFlagSet("history", "history <repo> [-n N] [--json]")
+	limit := fs.IntP("limit", "n", 20, "number of deployments to show, 0 for all")
+	asJSON := fs.Bool("json", false, "output json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	r, ok := lookupArg(fs)
+	if !ok {
+		return 2
+	}
+
+	history, err := readHistory(r, *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read history: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(history)
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tTYPE\tOUTCOME\tOLD\tNEW\tREF\tPUSHER\tDELIVERY\tDURATION\tERROR")
+	for _, d := range history {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			d.Start.Format("2006-01-02 15:04:05"), d.Type, d.Outcome, shortSHA(d.OldSHA), shortSHA(d.NewSHA),
+			d.Ref, d.Pusher, d.Delivery, d.End.Sub(d.Start).Round(time.Millisecond), d.Error)
+	}
+	tw.Flush()
+	return 0
+}
+
+func rollbackCommand(args []string) int {
+	fs := newFlagSet("rollback", "rollback <repo> [--to <sha>|--steps N]")
+	to := fs.String("to", "", "commit to roll back to, full sha or a previously deployed abbreviated sha")
+	steps := fs.Int("steps", 1, "number of deployments to go back")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	r, ok := lookupArg(fs)
+	if !ok {
+		return 2
+	}
+
+	params := url.Values{"repo": {r.Path}, "steps": {fmt.Sprint(*steps)}}
+	if *to != "" {
+		params.Set("to", *to)
+	}
+	body, err := apiRequest(http.MethodPost, "/api/rollback", params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rollback failed: %v\n", err)
+		return 1
+	}
+
+	var d deployment
+	if err := json.Unmarshal(body, &d); err != nil {
+		fmt.Fprintf(os.Stderr, "unexpected response: %s\n", body)
+		return 1
+	}
+	fmt.Printf("%v rolled back from %v to %v and pinned, run `gwg unpin %v` to resume updates\n",
+		r.Name(), shortSHA(d.OldSHA), shortSHA(d.NewSHA), r.Path)
+	return 0
+}
+
+func unpinCommand(args []string) int {
+	fs := newFlagSet("unpin", "unpin <repo>")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	r, ok := lookupArg(fs)
+	if !ok {
+		return 2
+	}
+
+	body, err := apiRequest(http.MethodPost, "/api/unpin", url.Values{"repo": {r.Path}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unpin failed: %v\n", err)
+		return 1
+	}
+	var resp struct {
+		Job string `json:"job"`
+	}
+	json.Unmarshal(body, &resp)
+	fmt.Printf("%v unpinned, updating to the latest commit in job %v\n", r.Name(), resp.Job)
+	return 0
+}
+
+func cancelCommand(args []string) int {
+	fs := newFlagSet("cancel", "cancel <repo>")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	r, ok := lookupArg(fs)
+	if !ok {
+		return 2
+	}
+
+	body, err := apiRequest(http.MethodPost, "/api/cancel", url.Values{"repo": {r.Path}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cancel failed: %v\n", err)
+		return 1
+	}
+	var resp struct {
+		Cancelled int `json:"cancelled"`
+	}
+	json.Unmarshal(body, &resp)
+	fmt.Printf("cancelled %v in-flight jobs for %v\n", resp.Cancelled, r.Name())
+	return 0
+}
+
+func queueCommand(args []string) int {
+	fs := newFlagSet("queue", "queue [--json]")
+	asJSON := fs.Bool("json", false, "output json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	body, err := apiRequest(http.MethodGet, "/api/queue", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "queue failed: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		os.Stdout.Write(body)
+		return 0
+	}
+	var m queueMetrics
+	if err := json.Unmarshal(body, &m); err != nil {
+		fmt.Fprintf(os.Stderr, "unexpected response: %s\n", body)
+		return 1
+	}
+
+	fmt.Printf("workers: %v/%v busy, %v waiting for a worker, %v pending\n\n", m.Active, m.Threads, m.Waiting, m.Pending)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tACTIVE\tWAITING\tLIMIT")
+	for host, h := range m.Hosts {
+		limit := "-"
+		if h.Limit > 0 {
+			limit = fmt.Sprint(h.Limit)
+		}
+		if host == "" {
+			host = "(local)"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", host, h.Active, h.Waiting, limit)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "PRIORITY\tREPO\tPATH\tRUNNING\tPENDING\tWAITING")
+	for _, r := range m.Repos {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", r.Priority, r.Repo, r.Path, r.Running, r.Pending, r.Waiting)
+	}
+	tw.Flush()
+	return 0
+}
+
+func deadCommand(args []string) int {
+	action := "list"
+	if len(args) > 0 && (args[0] == "list" || args[0] == "retry" || args[0] == "discard") {
+		action, args = args[0], args[1:]
+	}
+	fs := newFlagSet("dead", "dead [list] [--repo <repo>] [--json] | dead retry|discard <id>|--repo <repo>|--all")
+	repoArg := fs.String("repo", "", "only this repo's failed jobs (path or name)")
+	all := fs.Bool("all", false, "every failed job")
+	asJSON := fs.Bool("json", false, "output json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var path string
+	if *repoArg != "" {
+		c := conf()
+		idx, ok := c.LookupRepo(*repoArg)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "repository not found: %v\n", *repoArg)
+			return 2
+		}
+		path = c.Repos[idx].Path
+	}
+
+	if action == "list" {
+		list, err := readDeadLetters(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read dead letters: %v\n", err)
+			return 1
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(list)
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FAILED\tID\tREPO\tTYPE\tSHA\tDELIVERY\tATTEMPTS\tERROR")
+		for _, dl := range list {
+			var last string
+			if len(dl.Errors) > 0 {
+				last = dl.Errors[len(dl.Errors)-1]
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				dl.Failed.Format("2006-01-02 15:04:05"), dl.ID, dl.Repo, dl.Type, shortSHA(dl.SHA), dl.Delivery, dl.Attempts, last)
+		}
+		tw.Flush()
+		return 0
+	}
+
+	params := url.Values{}
+	switch {
+	case fs.NArg() == 1:
+		params.Set("id", fs.Arg(0))
+	case path != "":
+		params.Set("repo", path)
+	case *all:
+		params.Set("all", "true")
+	default:
+		fs.Usage()
+		return 2
+	}
+	body, err := apiRequest(http.MethodPost, "/api/dead/"+action, params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v failed: %v\n", action, err)
+		return 1
+	}
+	if action == "discard" {
+		var resp struct {
+			Discarded int `json:"discarded"`
+		}
+		json.Unmarshal(body, &resp)
+		fmt.Printf("discarded %v failed jobs\n", resp.Discarded)
+		return 0
+	}
+	var resp struct {
+		Retried map[string]string `json:"retried"`
+		Errors  map[string]string `json:"errors"`
+	}
+	json.Unmarshal(body, &resp)
+	for id, job := range resp.Retried {
+		fmt.Printf("%v queued again as job %v\n", id, job)
+	}
+	for id, err := range resp.Errors {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", id, err)
+	}
+	if len(resp.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
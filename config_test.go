@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLabelTypeDropsBadCommits(t *testing.T) {
+	sha := strings.Repeat("a", 40)
+	c := &config{Repos: []repo{
+		{URL: "full", LabelType: "commit", Label: sha},
+		{URL: "upper", LabelType: "commit", Label: strings.ToUpper(strings.Repeat("b", 40))},
+		{URL: "short", LabelType: "commit", Label: "1a2b3c4"},
+		{URL: "not hex", LabelType: "commit", Label: strings.Repeat("z", 40)},
+		{URL: "branch", LabelType: "branch", Label: "main"},
+		{URL: "unknown", LabelType: "bookmark", Label: "main"},
+	}}
+	c.validateLabelType()
+
+	var got []string
+	for _, r := range c.Repos {
+		got = append(got, r.URL+":"+r.LabelType)
+	}
+	if want := "full:commit upper:commit branch:branch unknown:branch"; strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %v", strings.Join(got, " "), want)
+	}
+}
+
+func TestValidateReleasesDropsSharedPaths(t *testing.T) {
+	c := &config{Repos: []repo{
+		{URL: "a", Directory: "/srv/a", DeployMode: "release"},
+		{URL: "b", Directory: "/srv/b", DeployMode: "release"},
+		{URL: "same dir", Directory: "/srv/c", DeployMode: "release", ReleaseDir: "/srv/a.releases"},
+		{URL: "same link", Directory: "/srv/d", DeployMode: "release", CurrentLink: "/srv/b.current/"},
+		{URL: "inplace", Directory: "/srv/e", DeployMode: "inplace", ReleaseDir: "/srv/a.releases"},
+	}}
+	c.setRepoDefaults()
+	c.validateReleases()
+
+	var got []string
+	for _, r := range c.Repos {
+		got = append(got, r.URL)
+	}
+	if want := "a b inplace"; strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %v", strings.Join(got, " "), want)
+	}
+	if c.Repos[0].ReleaseDir != "/srv/a.releases" || c.Repos[0].CurrentLink != "/srv/a.current" {
+		t.Errorf("got defaults %v and %v, want /srv/a.releases and /srv/a.current", c.Repos[0].ReleaseDir, c.Repos[0].CurrentLink)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetter is a job that failed after all its retries, kept until it's
+// retried or discarded
+type deadLetter struct {
+	ID       string          `json:"id"` // the failed job's id
+	Repo     string          `json:"repo"`
+	Path     string          `json:"path"`
+	Type     string          `json:"type"`
+	Delivery string          `json:"delivery,omitempty"`
+	Pusher   string          `json:"pusher,omitempty"`
+	SHA      string          `json:"sha,omitempty"`
+	Attempts int             `json:"attempts"`
+	Errors   []string        `json:"errors"` // every failed attempt, oldest first, then the job's error
+	Queued   time.Time       `json:"queued"`
+	Failed   time.Time       `json:"failed"`
+	Payload  json.RawMessage `json:"payload,omitempty"` // the original webhook delivery
+}
+
+var deadMutex sync.Mutex
+
+func deadDir() string {
+	return filepath.Join(conf().DataDir, "dead")
+}
+
+func deadFile(id string) string {
+	return filepath.Join(deadDir(), filepath.Base(id)+".json")
+}
+
+// attemptLog records a job's failed attempts, the retry policy finds it
+// through the job's context
+type attemptLog struct {
+	sync.Mutex
+	failed map[string]int // failed attempts by operation
+	last   string         // the operation that failed last, blank once it succeeds
+	errs   []string
+}
+
+type attemptLogKey struct{}
+
+// recordAttempt records an attempt at an operation against ctx's job, err is
+// nil for one that succeeded. Only failures are counted.
+func recordAttempt(ctx context.Context, what string, err error) {
+	l, ok := ctx.Value(attemptLogKey{}).(*attemptLog)
+	if !ok {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if err == nil {
+		if l.last == what {
+			l.last = ""
+		}
+		return
+	}
+	if l.failed == nil {
+		l.failed = make(map[string]int)
+	}
+	l.failed[what]++
+	l.last = what
+	l.errs = append(l.errs, fmt.Sprintf("%v attempt %v: %v", what, l.failed[what], err))
+}
+
+// count is how many attempts the job made at the operation it failed on, 1
+// when that wasn't a retried operation, e.g. a postUpdate command
+func (l *attemptLog) count() int {
+	if l.last == "" {
+		return 1
+	}
+	return l.failed[l.last]
+}
+
+// bury moves a failed job to the dead letter store
+func (j *job) bury(msg string) {
+	j.attempts.Lock()
+	dl := deadLetter{
+		ID:       j.id,
+		Repo:     j.repo.Name(),
+		Path:     j.repo.Path,
+		Type:     j.jobType,
+		Delivery: j.delivery,
+		Pusher:   j.pusher,
+		SHA:      j.sha,
+		Attempts: j.attempts.count(),
+		Errors:   append([]string{}, j.attempts.errs...),
+		Queued:   j.status.Queued,
+		Failed:   time.Now(),
+	}
+	j.attempts.Unlock()
+	if msg != "" && (len(dl.Errors) == 0 || !strings.HasSuffix(dl.Errors[len(dl.Errors)-1], ": "+msg)) {
+		dl.Errors = append(dl.Errors, msg)
+	}
+	if len(j.payload) > 0 && json.Valid(j.payload) {
+		dl.Payload = json.RawMessage(j.payload)
+	}
+
+	deadMutex.Lock()
+	defer deadMutex.Unlock()
+	if err := os.MkdirAll(deadDir(), 0750); err != nil {
+		log.Errorf("Failed to create dead letter directory: %v", err)
+		return
+	}
+	b, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		log.Errorf("Failed to encode dead letter: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(deadFile(dl.ID), b, 0640); err != nil {
+		log.Errorf("Failed to write dead letter: %v", err)
+		return
+	}
+	log.WithField("repo", dl.Repo).Warnf("Job %v failed after %v attempts, moved to the dead letter store", dl.ID, dl.Attempts)
+}
+
+// readDeadLetters returns the dead letters, oldest first, optionally only a repo's
+func readDeadLetters(path string) ([]deadLetter, error) {
+	deadMutex.Lock()
+	defer deadMutex.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(deadDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	list := []deadLetter{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var dl deadLetter
+		if err := json.Unmarshal(b, &dl); err != nil {
+			log.Errorf("Failed to read dead letter %v: %v", f, err)
+			continue
+		}
+		if path != "" && dl.Path != path {
+			continue
+		}
+		list = append(list, dl)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Failed.Before(list[b].Failed)
+	})
+	return list, nil
+}
+
+// selectDeadLetters returns the dead letter with the given id, every one of a
+// repo's or all of them
+func selectDeadLetters(id, path string, all bool) ([]deadLetter, error) {
+	if id == "" && path == "" && !all {
+		return nil, fmt.Errorf("pick a dead letter id, a repo or all")
+	}
+	list, err := readDeadLetters(path)
+	if err != nil || id == "" {
+		return list, err
+	}
+	for _, dl := range list {
+		if dl.ID == id {
+			return []deadLetter{dl}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// discardDeadLetter removes a dead letter from the store
+func discardDeadLetter(id string) error {
+	deadMutex.Lock()
+	defer deadMutex.Unlock()
+	return os.Remove(deadFile(id))
+}
+
+// retryDeadLetter queues the dead letter's job again and removes it from the
+// store, returning the new job
+func retryDeadLetter(dl deadLetter) (*job, error) {
+	c := conf()
+	idx, ok := c.FindRepo(dl.Path)
+	if !ok {
+		return nil, fmt.Errorf("repository %v is no longer configured", dl.Path)
+	}
+	j := newJob(&c.Repos[idx], dl.Type)
+	j.delivery = dl.Delivery
+	j.pusher = dl.Pusher
+	j.sha = dl.SHA
+	j.payload = dl.Payload
+	journalJob(j)
+	if err := discardDeadLetter(dl.ID); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	log.WithField("repo", dl.Repo).Warnf("Retrying dead letter %v as job %v", dl.ID, j.id)
+	sched.submit(j)
+	return j, nil
+}
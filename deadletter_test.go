@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAttemptCount(t *testing.T) {
+	fail := errors.New("boom")
+	for _, c := range []struct {
+		name     string
+		attempts []error // by operation, in order
+		ops      []string
+		want     int
+		errs     int
+	}{
+		{"no retried operations", nil, nil, 1, 0},
+		{"every operation succeeded", []error{nil, nil, nil}, []string{"fetch", "resolve", "hard reset work tree"}, 1, 0},
+		{"fetch ran out of attempts", []error{fail, fail, fail}, []string{"fetch", "fetch", "fetch"}, 3, 3},
+		{"fetch recovered", []error{fail, fail, nil, nil}, []string{"fetch", "fetch", "fetch", "resolve"}, 1, 2},
+		{"reset failed after a flaky fetch", []error{fail, nil, fail, fail}, []string{"fetch", "fetch", "hard reset work tree", "hard reset work tree"}, 2, 3},
+	} {
+		var l attemptLog
+		ctx := context.WithValue(context.Background(), attemptLogKey{}, &l)
+		for i, err := range c.attempts {
+			recordAttempt(ctx, c.ops[i], err)
+		}
+		if got := l.count(); got != c.want {
+			t.Errorf("%v: got %v attempts, want %v", c.name, got, c.want)
+		}
+		if len(l.errs) != c.errs {
+			t.Errorf("%v: got %v errors, want %v", c.name, len(l.errs), c.errs)
+		}
+	}
+}
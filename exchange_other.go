@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// exchange swaps the paths a and b, not atomically
+func exchange(a, b string) error {
+	return exchangeByRename(a, b)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// healthCheck is polled after a deploy, the job only succeeds once it passes
+type healthCheck struct {
+	URL     string  `mapstructure:"url"`
+	Status  int     `mapstructure:"status"`  // expected status code, defaults to 200
+	Body    string  `mapstructure:"body"`    // regex the response body must match
+	Timeout float64 `mapstructure:"timeout"` // seconds per request, defaults to 5
+	Retries *int    `mapstructure:"retries"` // attempts after the first, 0 for a single attempt, defaults to 10
+	Delay   float64 `mapstructure:"delay"`   // seconds before the first and between attempts, defaults to 3
+}
+
+// validateHealthChecks drops health checks that can't work, defaults are filled in when checking
+func (c *config) validateHealthChecks() {
+	for i := range c.Repos {
+		hc := c.Repos[i].HealthCheck
+		if hc == nil {
+			continue
+		}
+		if isEmpty(hc.URL) {
+			log.Errorf("Health check for repo %v has no url, ignoring it", c.Repos[i].Name())
+			c.Repos[i].HealthCheck = nil
+			continue
+		}
+		if hc.Retries != nil && *hc.Retries < 0 {
+			log.Errorf("Invalid health check retries %v for repo %v, using 0", *hc.Retries, c.Repos[i].Name())
+			*hc.Retries = 0
+		}
+		if _, err := regexp.Compile(hc.Body); err != nil {
+			log.Errorf("Invalid health check body regex for repo %v, ignoring the health check: %v", c.Repos[i].Name(), err)
+			c.Repos[i].HealthCheck = nil
+		}
+	}
+}
+
+// checkHealth polls the repo's health check until it passes or runs out of retries
+func (r *repo) checkHealth(ctx context.Context) error {
+	hc := r.HealthCheck
+	if hc == nil {
+		return nil
+	}
+	rlog := log.WithFields(logrus.Fields{
+		"repo": r.Name(),
+		"path": r.Path,
+		"url":  hc.URL,
+	})
+
+	status := hc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	timeout := time.Duration(hc.Timeout * float64(time.Second))
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	retries := 10
+	if hc.Retries != nil {
+		retries = *hc.Retries
+	}
+	delay := time.Duration(hc.Delay * float64(time.Second))
+	if delay <= 0 {
+		delay = 3 * time.Second
+	}
+	body := regexp.MustCompile(hc.Body)
+	client := &http.Client{Timeout: timeout}
+
+	var err error
+	for a := 0; a <= retries; a++ {
+		// give the service a moment, it's usually restarting
+		if !sleep(ctx, delay) {
+			return ctx.Err()
+		}
+		if err = probe(ctx, client, hc.URL, status, body); err == nil {
+			rlog.Infof("Health check passed after %v attempts", a+1)
+			return nil
+		}
+		rlog.Warnf("Health check attempt %v/%v failed: %v", a+1, retries+1, err)
+	}
+	return fmt.Errorf("health check %v failed after %v attempts: %v", hc.URL, retries+1, err)
+}
+
+// probe makes a single health check request
+func probe(ctx context.Context, client *http.Client, url string, status int, body *regexp.Regexp) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// bodies are only matched up to 1MB
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != status {
+		return fmt.Errorf("got status %v, expected %v", resp.StatusCode, status)
+	}
+	if !body.Match(b) {
+		return fmt.Errorf("body doesn't match %q", body)
+	}
+	return nil
+}
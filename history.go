@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// deployment is a single clone / update attempt, one per line in the repo's history file
+type deployment struct {
+	Repo          string          `json:"repo"`
+	Path          string          `json:"path"`
+	Type          string          `json:"type"`
+	Ref           string          `json:"ref"`
+	Remote        string          `json:"remote,omitempty"` // the remote that served the clone / fetch
+	OldSHA        string          `json:"oldSha,omitempty"`
+	NewSHA        string          `json:"newSha,omitempty"`
+	Delivery      string          `json:"delivery,omitempty"`
+	Pusher        string          `json:"pusher,omitempty"`
+	Start         time.Time       `json:"start"`
+	End           time.Time       `json:"end"`
+	Outcome       string          `json:"outcome"` // succeeded, failed, skipped, held, vetoed, cancelled, recovered or rolled-back
+	Error         string          `json:"error,omitempty"`
+	Reason        string          `json:"reason,omitempty"`       // why the update was vetoed
+	RolledBackTo  string          `json:"rolledBackTo,omitempty"` // the commit put back by autoRollback
+	RollbackError string          `json:"rollbackError,omitempty"`
+	TriggerError  string          `json:"triggerError,omitempty"` // the deploy went ahead, but the trigger file couldn't be written
+	Commands      []commandResult `json:"commands,omitempty"`     // pre / post update commands that ran
+
+	ctx context.Context // the job's, to tell cancellations from failures
+}
+
+var historyMutex sync.Mutex
+
+func (r *repo) newDeployment(j *job) *deployment {
+	d := &deployment{
+		Repo:  r.Name(),
+		Path:  r.Path,
+		Type:  "update",
+		Ref:   r.labelRef(),
+		Start: time.Now(),
+	}
+	if j != nil {
+		j.result = d
+		d.ctx = j.ctx
+		d.Type = j.jobType
+		d.Delivery = j.delivery
+		d.Pusher = j.pusher
+	}
+	return d
+}
+
+func (d *deployment) fail(err error) {
+	d.Outcome = "failed"
+	d.Error = err.Error()
+}
+
+func (d *deployment) skip() {
+	d.Outcome = "skipped"
+}
+
+// rolledBack is a failure undone by autoRollback, keeping the error that
+// caused it and any from the rollback's own post update steps
+func (d *deployment) rolledBack(hash plumbing.Hash, err error) {
+	d.Outcome = "rolled-back"
+	d.RolledBackTo = hash.String()
+	if err != nil {
+		d.RollbackError = err.Error()
+	}
+}
+
+// veto is a cancellation by the preUpdate command
+func (d *deployment) veto(reason string) {
+	d.Outcome = "vetoed"
+	d.Reason = reason
+}
+
+// hold is a skip because the repo is pinned
+func (d *deployment) hold() {
+	d.Outcome = "held"
+}
+
+func (d *deployment) succeed(hash plumbing.Hash) {
+	d.Outcome = "succeeded"
+	d.NewSHA = hash.String()
+}
+
+// recovered keeps the error that caused the repo to be recloned
+func (d *deployment) recovered(hash plumbing.Hash) {
+	d.Outcome = "recovered"
+	d.NewSHA = hash.String()
+}
+
+// stateName turns a repo's webhook path into a file name for its state under data_dir
+func stateName(path string) string {
+	return strings.Replace(strings.Trim(path, "/"), "/", "_", -1)
+}
+
+// historyFile is where the history for the repo with the given webhook path is kept
+func historyFile(path string) string {
+	return filepath.Join(conf().DataDir, "history", stateName(path)+".jsonl")
+}
+
+// save appends the deployment to the repo's history file
+func (d *deployment) save() {
+	d.End = time.Now()
+	if d.Outcome == "" {
+		d.Outcome = "failed"
+	}
+	if d.Outcome == "failed" && d.ctx != nil && d.ctx.Err() == context.Canceled {
+		d.Outcome = "cancelled"
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	file := historyFile(d.Path)
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		log.Errorf("Failed to create history directory: %v", err)
+		return
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		log.Errorf("Failed to open history file: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(d); err != nil {
+		log.Errorf("Failed to write history: %v", err)
+	}
+}
+
+// readHistory returns up to limit of the repo's most recent deployments, newest
+// first, a limit of 0 returns everything.
+func readHistory(r *repo, limit int) ([]deployment, error) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	f, err := os.Open(historyFile(r.Path))
+	if os.IsNotExist(err) {
+		return []deployment{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var all []deployment
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d deployment
+		// skip a partially written line rather than losing the lot
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			continue
+		}
+		all = append(all, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	history := make([]deployment, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		if limit > 0 && len(history) == limit {
+			break
+		}
+		history = append(history, all[i])
+	}
+	return history, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// command is a shell command run around an update
+type command struct {
+	Run     string   `mapstructure:"run"`     // run with /bin/sh -c
+	Dir     string   `mapstructure:"dir"`     // defaults to the deployed directory
+	Timeout int      `mapstructure:"timeout"` // seconds, defaults to 60
+	User    string   `mapstructure:"user"`    // run as this user, gwg must be running as root
+	Env     []string `mapstructure:"env"`     // extra KEY=value variables
+}
+
+// commandResult is how a command went, recorded with the deployment
+type commandResult struct {
+	Stage    string  `json:"stage"` // preUpdate or postUpdate
+	Run      string  `json:"run"`
+	ExitCode int     `json:"exitCode"` // -1 if it didn't start or was killed
+	Seconds  float64 `json:"seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// deployedDir is where the deployed tree lives, the current link in release mode
+func (r *repo) deployedDir() string {
+	if r.IsRelease() {
+		return r.CurrentLink
+	}
+	return r.Directory
+}
+
+// commandEnv is the environment commands run with, describing the deployment
+func (r *repo) commandEnv(d *deployment) []string {
+	return append(os.Environ(),
+		"GWG_REPO="+r.Name(),
+		"GWG_PATH="+r.Path,
+		"GWG_DIRECTORY="+r.deployedDir(),
+		"GWG_REF="+d.Ref,
+		"GWG_OLD_SHA="+d.OldSHA,
+		"GWG_NEW_SHA="+d.NewSHA,
+		"GWG_DELIVERY="+d.Delivery,
+		"GWG_PUSHER="+d.Pusher,
+	)
+}
+
+// credential looks up the uid / gid to run as
+func credential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// killWait is how long to keep reading a killed command's output
+const killWait = 5 * time.Second
+
+// runHook runs c, streaming its output into the log line by line, and
+// returns the result and its stdout. A non-zero exit is an error.
+func (r *repo) runHook(ctx context.Context, stage string, c command, env []string) (commandResult, string, error) {
+	rlog := log.WithFields(logrus.Fields{
+		"repo":  r.Name(),
+		"path":  r.Path,
+		"stage": stage,
+	})
+	res := commandResult{Stage: stage, Run: c.Run, ExitCode: -1}
+	start := time.Now()
+	fail := func(err error) (commandResult, string, error) {
+		res.Seconds = time.Since(start).Seconds()
+		res.Error = err.Error()
+		return res, "", err
+	}
+
+	timeout := time.Duration(c.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.Command("/bin/sh", "-c", c.Run)
+	cmd.Dir = c.Dir
+	if cmd.Dir == "" {
+		cmd.Dir = r.deployedDir()
+	}
+	cmd.Env = append(env, c.Env...)
+	// own process group so a timeout kills everything the shell started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if c.User != "" {
+		cred, err := credential(c.User)
+		if err != nil {
+			return fail(fmt.Errorf("failed to look up user %v: %v", c.User, err))
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fail(err)
+	}
+
+	rlog.Infof("Running %v command: %v", stage, c.Run)
+	if err := cmd.Start(); err != nil {
+		return fail(fmt.Errorf("failed to start %v command %q: %v", stage, c.Run, err))
+	}
+
+	// kill the group on timeout or cancellation. Anything that left the group
+	// could still hold the output open, give up on reading it after a while.
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-cctx.Done():
+		case <-exited:
+			return
+		}
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		select {
+		case <-time.After(killWait):
+			stdout.Close()
+			stderr.Close()
+		case <-exited:
+		}
+	}()
+
+	var out bytes.Buffer
+	var wg sync.WaitGroup
+	stream := func(rd io.Reader, keep bool, logf func(string, ...interface{})) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(rd)
+		for scanner.Scan() {
+			if keep {
+				out.Write(scanner.Bytes())
+				out.WriteByte('\n')
+			}
+			logf("%s", scanner.Text())
+		}
+	}
+	wg.Add(2)
+	go stream(stdout, true, rlog.WithField("stream", "stdout").Infof)
+	go stream(stderr, false, rlog.WithField("stream", "stderr").Warnf)
+	wg.Wait()
+
+	err = cmd.Wait()
+	close(exited)
+	res.Seconds = time.Since(start).Seconds()
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	switch {
+	case cctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("%v command %q timed out after %v", stage, c.Run, timeout)
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case err != nil:
+		err = fmt.Errorf("%v command %q failed with exit code %v", stage, c.Run, res.ExitCode)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		rlog.Error(err)
+		return res, strings.TrimSpace(out.String()), err
+	}
+	rlog.Infof("%v command finished in %.1fs", stage, res.Seconds)
+	return res, strings.TrimSpace(out.String()), nil
+}
+
+// postUpdate runs the repo's postUpdate commands in order after a successful
+// deploy, stopping at the first one that fails
+func (r *repo) postUpdate(ctx context.Context, d *deployment) error {
+	env := r.commandEnv(d)
+	for _, c := range r.PostUpdate {
+		res, _, err := r.runHook(ctx, "postUpdate", c, env)
+		d.Commands = append(d.Commands, res)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preUpdate runs the repo's preUpdate command, if it has one, with the
+// incoming commit as GWG_NEW_SHA. Exiting non-zero vetoes the update, its
+// stdout is the reason. Failing to run at all, or timing out, is an error.
+func (r *repo) preUpdate(ctx context.Context, d *deployment, sha string) (bool, string, error) {
+	if r.PreUpdate == nil || isEmpty(r.PreUpdate.Run) {
+		return false, "", nil
+	}
+	env := append(r.commandEnv(d), "GWG_NEW_SHA="+sha)
+	res, out, err := r.runHook(ctx, "preUpdate", *r.PreUpdate, env)
+	d.Commands = append(d.Commands, res)
+	if err == nil {
+		return false, "", nil
+	}
+	// killed by a timeout or cancellation exits -1
+	if res.ExitCode > 0 {
+		if out == "" {
+			out = fmt.Sprintf("preUpdate command exited with %v", res.ExitCode)
+		}
+		return true, out, nil
+	}
+	return false, "", err
+}
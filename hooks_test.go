@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	r := &repo{URL: "https://example.com/a.git", Directory: t.TempDir()}
+	for _, c := range []struct {
+		run      string
+		exitCode int
+		out      string
+		err      string
+	}{
+		{"echo hello; echo oops >&2", 0, "hello", ""},
+		{"echo $GWG_TEST", 0, "from env", ""},
+		{"echo no; exit 3", 3, "no", "failed with exit code 3"},
+	} {
+		res, out, err := r.runHook(context.Background(), "postUpdate", command{Run: c.run, Env: []string{"GWG_TEST=from env"}}, nil)
+		if res.ExitCode != c.exitCode || out != c.out {
+			t.Errorf("%q: got exit %v output %q, want %v %q", c.run, res.ExitCode, out, c.exitCode, c.out)
+		}
+		if (err == nil) != (c.err == "") || err != nil && !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %v, want %q", c.run, err, c.err)
+		}
+	}
+}
+
+func TestRunHookTimeoutKillsGroup(t *testing.T) {
+	r := &repo{URL: "https://example.com/a.git", Directory: t.TempDir()}
+	start := time.Now()
+	// the background sleep keeps stdout open unless the whole group is killed
+	res, _, err := r.runHook(context.Background(), "postUpdate", command{Run: "sleep 30 & sleep 30", Timeout: 1}, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if res.ExitCode != -1 {
+		t.Errorf("got exit code %v, want -1", res.ExitCode)
+	}
+	if d := time.Since(start); d > killWait {
+		t.Errorf("took %v, the process group wasn't killed", d)
+	}
+}
+
+func TestRunHookCancel(t *testing.T) {
+	r := &repo{URL: "https://example.com/a.git", Directory: t.TempDir()}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, _, err := r.runHook(ctx, "postUpdate", command{Run: "sleep 30"}, nil); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errSuperseded = errors.New("superseded by a later job")
+
+// execute runs the job, called by the scheduler
+func (j *job) execute() {
+	switch j.jobType {
+	case "clone":
+		j.repo.clone(j)
+	case "update", "checkout":
+		j.repo.update(j)
+	case "rollback":
+		j.result, j.err = j.repo.rollback(j)
+	}
+}
+
+// release frees the job's context and wakes anyone waiting on it
+func (j *job) release() {
+	j.cancel()
+	close(j.finished)
+}
+
+// done records how the job ended and releases it
+func (j *job) done() {
+	state, msg := j.outcome()
+	sha := j.sha
+	if j.result != nil && j.result.NewSHA != "" {
+		sha = j.result.NewSHA
+	}
+	now := time.Now()
+
+	tracker.Lock()
+	j.status.State = state
+	j.status.Error = msg
+	if j.result != nil {
+		j.status.Reason = j.result.Reason
+	}
+	j.status.SHA = sha
+	j.status.Finished = &now
+	if tracker.running[j.repo.Path] == j {
+		delete(tracker.running, j.repo.Path)
+	}
+	tracker.Unlock()
+
+	// rollbacks are run by hand, whoever ran it sees the error
+	if state == "failed" && j.jobType != "rollback" {
+		j.bury(msg)
+	}
+	j.sendCallbacks(state)
+	j.notify(state)
+	journalDone(j)
+	j.release()
+}
+
+// outcomeStates maps deployment outcomes to job states
+var outcomeStates = map[string]string{
+	"succeeded":   "succeeded",
+	"recovered":   "succeeded",
+	"failed":      "failed",
+	"skipped":     "skipped",
+	"held":        "skipped",
+	"cancelled":   "cancelled",
+	"vetoed":      "cancelled",
+	"rolled-back": "rolled-back",
+}
+
+// outcome is the job's final state and error message
+func (j *job) outcome() (string, string) {
+	if j.result != nil {
+		return outcomeStates[j.result.Outcome], j.result.Error
+	}
+	switch {
+	case j.err == errSuperseded:
+		return "skipped", j.err.Error()
+	case j.err == nil, j.err == context.Canceled:
+		// never ran
+		return "cancelled", ""
+	}
+	return "failed", j.err.Error()
+}
+
+// timeout returns the repo's override when set, otherwise the global setting, both in seconds
+func timeout(repo, global int) time.Duration {
+	if repo > 0 {
+		return time.Duration(repo) * time.Second
+	}
+	return time.Duration(global) * time.Second
+}
+
+func (r *repo) cloneTimeout() time.Duration {
+	return timeout(r.CloneTimeout, conf().CloneTimeout)
+}
+
+func (r *repo) fetchTimeout() time.Duration {
+	return timeout(r.FetchTimeout, conf().FetchTimeout)
+}
+
+// sleep waits for d or until ctx is done, returning false if it was cancelled
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// dirLocks has a slot per git directory, held while a go-git call is working
+// in it
+var dirLocks = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+func dirLock(dir string) chan struct{} {
+	dirLocks.Lock()
+	defer dirLocks.Unlock()
+	dir = filepath.Clean(dir)
+	l, ok := dirLocks.m[dir]
+	if !ok {
+		l = make(chan struct{}, 1)
+		dirLocks.m[dir] = l
+	}
+	return l
+}
+
+// run calls fn and returns its error, or ctx's as soon as ctx is done. go-git
+// only honours the context while the pack is transferred, a stalled ssh
+// handshake or ref advertisement would otherwise hang forever. An abandoned
+// call finishes in the background once its connection drops, dir stays locked
+// until it has, so retries and later jobs wait for it (or their own context)
+// rather than writing to the same repository at once. A blank dir isn't locked.
+func run(ctx context.Context, dir string, fn func() error) error {
+	var lock chan struct{}
+	if dir != "" {
+		lock = dirLock(dir)
+		select {
+		case lock <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		if lock != nil {
+			defer func() { <-lock }()
+		}
+		errc <- fn()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journalEntry is a line in the job journal, a job is outstanding from its
+// last "queued" entry until its "done" entry
+type journalEntry struct {
+	Op       string          `json:"op"` // queued or done
+	ID       string          `json:"id"`
+	Path     string          `json:"path,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	Delivery string          `json:"delivery,omitempty"`
+	Pusher   string          `json:"pusher,omitempty"`
+	SHA      string          `json:"sha,omitempty"`
+	Queued   time.Time       `json:"queued,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// journal keeps webhook deliveries on disk until their job has finished, so
+// they survive a restart or crash
+var journal = struct {
+	sync.Mutex
+	f    *os.File
+	open map[string]bool // ids of outstanding jobs
+}{
+	open: make(map[string]bool),
+}
+
+func journalFile() string {
+	return filepath.Join(conf().DataDir, "queue.jsonl")
+}
+
+// write appends an entry, must hold the journal lock
+func writeJournal(e journalEntry) {
+	if journal.f == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Failed to write job journal: %v", err)
+		return
+	}
+	if _, err := journal.f.Write(append(b, '\n')); err != nil {
+		log.Errorf("Failed to write job journal: %v", err)
+		return
+	}
+	if err := journal.f.Sync(); err != nil {
+		log.Errorf("Failed to sync job journal: %v", err)
+	}
+}
+
+func queuedEntry(j *job) journalEntry {
+	return journalEntry{
+		Op:       "queued",
+		ID:       j.id,
+		Path:     j.repo.Path,
+		Type:     j.jobType,
+		Delivery: j.delivery,
+		Pusher:   j.pusher,
+		SHA:      j.sha,
+		Queued:   j.status.Queued,
+		Payload:  j.payload,
+	}
+}
+
+// journalJob records a queued job, call before acknowledging the delivery
+func journalJob(j *job) {
+	journal.Lock()
+	defer journal.Unlock()
+	writeJournal(queuedEntry(j))
+	journal.open[j.id] = true
+}
+
+// journalFold records that j was folded into p, p takes over j's place in the journal
+func journalFold(p, j *job) {
+	journal.Lock()
+	defer journal.Unlock()
+	if !journal.open[j.id] {
+		return
+	}
+	writeJournal(queuedEntry(p))
+	journal.open[p.id] = true
+	writeJournal(journalEntry{Op: "done", ID: j.id})
+	delete(journal.open, j.id)
+}
+
+// journalDone records a finished job, the journal is truncated once no jobs are outstanding
+func journalDone(j *job) {
+	journal.Lock()
+	defer journal.Unlock()
+	if !journal.open[j.id] {
+		return
+	}
+	writeJournal(journalEntry{Op: "done", ID: j.id})
+	delete(journal.open, j.id)
+
+	if len(journal.open) == 0 && journal.f != nil {
+		if err := journal.f.Truncate(0); err != nil {
+			log.Errorf("Failed to compact job journal: %v", err)
+		}
+	}
+}
+
+// closeJournal stops journaling, jobs still outstanding stay in the journal
+// and are replayed on the next start
+func closeJournal() {
+	journal.Lock()
+	defer journal.Unlock()
+	if journal.f != nil {
+		journal.f.Close()
+		journal.f = nil
+	}
+}
+
+// readJournal returns the outstanding jobs in the order they were queued
+func readJournal(file string) ([]journalEntry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []string
+	latest := make(map[string]journalEntry)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		// a partially written line is from a crash mid-write, the delivery was never acknowledged
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		switch e.Op {
+		case "queued":
+			if _, ok := latest[e.ID]; !ok {
+				order = append(order, e.ID)
+			}
+			latest[e.ID] = e
+		case "done":
+			delete(latest, e.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var outstanding []journalEntry
+	for _, id := range order {
+		if e, ok := latest[id]; ok {
+			outstanding = append(outstanding, e)
+			delete(latest, id)
+		}
+	}
+	return outstanding, nil
+}
+
+// openJournal compacts the journal down to the outstanding jobs, opens it for
+// writing and returns the outstanding jobs to replay
+func openJournal() ([]journalEntry, error) {
+	file := journalFile()
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return nil, err
+	}
+	outstanding, err := readJournal(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range outstanding {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	if err := os.Rename(tmp, file); err != nil {
+		return nil, err
+	}
+
+	f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	journal.Lock()
+	journal.f = f
+	for _, e := range outstanding {
+		journal.open[e.ID] = true
+	}
+	journal.Unlock()
+	return outstanding, nil
+}
+
+// replayJournal queues the jobs that hadn't finished when gwg last stopped,
+// call before accepting webhooks
+func replayJournal() {
+	outstanding, err := openJournal()
+	if err != nil {
+		log.Errorf("Failed to open job journal, queued deliveries won't survive a restart: %v", err)
+		return
+	}
+
+	for _, e := range outstanding {
+		c := conf()
+		idx, ok := c.FindRepo(e.Path)
+		if !ok {
+			log.Warnf("Dropping journaled %v job %v, repository %v is no longer configured", e.Type, e.ID, e.Path)
+			journalDone(&job{id: e.ID})
+			continue
+		}
+		// keep the id so anything polling the job can carry on after the restart
+		j := trackJob(&job{
+			id:       e.ID,
+			repo:     &c.Repos[idx],
+			jobType:  e.Type,
+			delivery: e.Delivery,
+			pusher:   e.Pusher,
+			sha:      e.SHA,
+			payload:  e.Payload,
+		})
+		log.WithField("repo", c.Repos[idx].Name()).Warnf("Replaying %v job %v for delivery %v", e.Type, e.ID, e.Delivery)
+		sched.submit(j)
+	}
+}
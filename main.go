@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -15,21 +17,32 @@ import (
 	"github.com/spf13/viper"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
 type config struct {
-	Listen     string `mapstructure:"listen"`
-	Port       string `mapstructure:"port"`
-	RetryCount int    `mapstructure:"retry_count"`
-	RetryDelay int    `mapstructure:"retry_delay"`
-	Initialise bool   `mapstructure:"initialise"`
-	Threads    int    `mapstructure:"threads"`
-	Logging    logger
-	Logfile    *os.File
-	LastUpdate time.Time
-	Repos      []repo
-	DataPasser *DataPasser
+	Listen           string         `mapstructure:"listen"`
+	Port             string         `mapstructure:"port"`
+	RetryCount       int            `mapstructure:"retry_count"`
+	RetryDelay       int            `mapstructure:"retry_delay"`
+	Initialise       bool           `mapstructure:"initialise"`
+	Threads          int            `mapstructure:"threads"`
+	DataDir          string         `mapstructure:"data_dir"`
+	MirrorDir        string         `mapstructure:"mirror_dir"`
+	CloneTimeout     int            `mapstructure:"clone_timeout"` // seconds
+	FetchTimeout     int            `mapstructure:"fetch_timeout"` // seconds
+	APIToken         string         `mapstructure:"api_token"`
+	DrainTimeout     int            `mapstructure:"drain_timeout"` // seconds
+	Retry            retryPolicy    `mapstructure:"retry"`
+	ReconcileOnStart bool           `mapstructure:"reconcile_on_start"`
+	HostThreads      int            `mapstructure:"host_threads"` // max jobs per remote host, 0 for no limit
+	HostLimits       map[string]int `mapstructure:"host_limits"`  // per host overrides of host_threads
+	Notifiers        []notifier     `mapstructure:"notifiers"`
+	Callbacks        []callback     `mapstructure:"callbacks"` // POSTed each finished job
+	Logging          logger
+	Logfile          *os.File
+	LastUpdate       time.Time
+	Repos            []repo
+	DataPasser       *DataPasser
 }
 
 type logger struct {
@@ -40,32 +53,73 @@ type logger struct {
 }
 
 type repo struct {
-	URL           string `mapstructure:"url"`
-	Path          string `mapstructure:"path"`
-	Directory     string `mapstructure:"directory"`
-	Label         string `mapstructure:"label"`
-	LabelType     string `mapstructure:"labelType"`
-	Remote        string `mapstructure:"remote"`
-	Secret        string `mapstructure:"secret"`
-	SSHPrivKey    string `mapstructure:"sshPrivKey"`
-	SSHPassPhrase string `mapstructure:"sshPassPhrase"`
-	Trigger       string `mapstructure:"trigger"`
-	Busy          bool   // when clone / update
+	URL               string       `mapstructure:"url"`
+	Path              string       `mapstructure:"path"`
+	Directory         string       `mapstructure:"directory"`
+	Label             string       `mapstructure:"label"`
+	LabelType         string       `mapstructure:"labelType"`
+	Remote            string       `mapstructure:"remote"`
+	Secret            string       `mapstructure:"secret"`
+	SSHPrivKey        string       `mapstructure:"sshPrivKey"`
+	SSHPassPhrase     string       `mapstructure:"sshPassPhrase"`
+	Remotes           []remote     `mapstructure:"remotes"`
+	Trigger           string       `mapstructure:"trigger"`
+	TriggerFormat     string       `mapstructure:"triggerFormat"` // touch, json or env
+	DeployMode        string       `mapstructure:"deployMode"`
+	ReleaseDir        string       `mapstructure:"releaseDir"`
+	CurrentLink       string       `mapstructure:"currentLink"`
+	KeepReleases      int          `mapstructure:"keepReleases"`
+	CloneTimeout      int          `mapstructure:"cloneTimeout"`
+	FetchTimeout      int          `mapstructure:"fetchTimeout"`
+	Priority          int          `mapstructure:"priority"`          // higher runs first when workers are short
+	ReconcileInterval string       `mapstructure:"reconcileInterval"` // e.g. 15m
+	ReconcileCron     string       `mapstructure:"reconcileCron"`     // 5 field cron expression
+	PreUpdate         *command     `mapstructure:"preUpdate"`         // can veto an update by exiting non-zero
+	PostUpdate        []command    `mapstructure:"postUpdate"`        // run after a successful update
+	AutoRollback      bool         `mapstructure:"autoRollback"`      // go back to the previous commit when the post update steps or health check fail
+	HealthCheck       *healthCheck `mapstructure:"healthCheck"`       // must pass before a deploy counts as a success
+	Reload            *reload      `mapstructure:"reload"`            // signal a service after a successful update
+	Retry             retryPolicy  `mapstructure:"retry"`             // overrides the global retry policy
 }
 
 type job struct {
-	repo    *repo
-	jobType string
+	id       string
+	repo     *repo
+	host     string // the primary remote's host, for host_threads
+	jobType  string
+	delivery string // github delivery id, blank when not triggered by a webhook
+	pusher   string
+	sha      string // the pushed commit, if known
+	to       string // rollback target sha
+	steps    int    // rollback steps
+	ctx      context.Context
+	cancel   context.CancelFunc
+	finished chan struct{} // closed once the job has run, or been dropped
+	result   *deployment
+	err      error
+	status   jobStatus // guarded by tracker
+	payload  []byte    // the webhook delivery
+	attempts attemptLog
 }
 
 // DataPasser - A way to pass extra arguments into http.HandleFunc
 type DataPasser struct {
-	jobs    chan *job
-	threads int
+	jobs chan *job
+}
+
+// current holds the global config. A reload publishes a new one rather than
+// changing it, so read it once through conf() and never modify what you get.
+var current atomic.Value
+
+func init() {
+	current.Store(&config{})
+}
+
+// conf returns the current config
+func conf() *config {
+	return current.Load().(*config)
 }
 
-// C is global config
-var C config
 var mutex sync.Mutex
 var log = logrus.New()
 
@@ -78,6 +132,22 @@ func (c *config) FindRepo(path string) (int, bool) {
 	return 0, false
 }
 
+// LookupRepo finds a repo by webhook path or short name, as used on the command line and api
+func (c *config) LookupRepo(id string) (int, bool) {
+	if isEmpty(id) {
+		return 0, false
+	}
+	if idx, ok := c.FindRepo(id); ok {
+		return idx, true
+	}
+	for r := range c.Repos {
+		if c.Repos[r].Name() == id {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
 func cleanURL(url string) string {
 	// strip trailing slash
 	if url[len(url)-1] == '/' {
@@ -86,173 +156,256 @@ func cleanURL(url string) string {
 	return url
 }
 
-func (r *repo) finished() {
-	r.Busy = false
-}
-
-func (r *repo) waitForCompletion() {
+func (r *repo) clone(j *job) {
 	rlog := log.WithFields(logrus.Fields{
 		"repo":      r.Name(),
 		"path":      r.Path,
 		"label":     r.Label,
 		"labelType": r.LabelType,
 	})
-	// check if update already in progress and let it finish
-	for {
-		if r.Busy {
-			rlog.Warnln("Repo is in the middle of an update, waiting...")
-			time.Sleep(3 * time.Second)
-		} else {
-			break
-		}
+
+	d := r.newDeployment(j)
+	defer d.save()
+
+	served, err := r.cloneInto(j.ctx, r.Directory)
+	if err != nil {
+		rlog.Errorf("Failed to clone repository: %v", err)
+		d.fail(err)
+		return
 	}
-}
+	d.Remote = served.Name
 
-func (r *repo) clone() {
-	defer r.finished()
-	rlog := log.WithFields(logrus.Fields{
-		"repo":      r.Name(),
-		"path":      r.Path,
-		"label":     r.Label,
-		"labelType": r.LabelType,
-	})
+	rlog.Info("Cloned repository")
 
-	r.waitForCompletion()
-	r.Busy = true
-	sshAuth, err := ssh.NewPublicKeysFromFile("git", r.SSHPrivKey, r.SSHPassPhrase)
+	head, err := r.deployHead()
 	if err != nil {
-		rlog.Errorf("Failed to setup ssh auth: %v", err)
+		rlog.Error(err)
+		d.fail(err)
 		return
 	}
+	d.succeed(head)
+
+	if err := r.afterDeploy(j.ctx, d); err != nil {
+		d.fail(err)
+	}
+}
+
+// labelRef is the upstream reference for the configured label, or the label
+// itself for commits and revisions
+func (r *repo) labelRef() string {
+	switch r.LabelType {
+	case "tag":
+		return "refs/tags/" + r.Label
+	case "commit", "revision":
+		return r.Label
+	}
+	return "refs/heads/" + r.Label
+}
+
+// target resolves the commit the work tree should be at for the configured label
+func (r *repo) target(repo *git.Repository, remote string) (plumbing.Hash, error) {
+	switch r.LabelType {
+	case "commit":
+		hash := plumbing.NewHash(r.Label)
+		if _, err := repo.CommitObject(hash); err != nil {
+			if err == plumbing.ErrObjectNotFound {
+				return plumbing.ZeroHash, permanentError{fmt.Errorf("failed to find commit %v: %v", r.Label, err)}
+			}
+			return plumbing.ZeroHash, fmt.Errorf("failed to find commit %v: %v", r.Label, err)
+		}
+		return hash, nil
+	case "revision":
+		hash, err := repo.ResolveRevision(plumbing.Revision(r.Label))
+		if err != nil {
+			if err == plumbing.ErrReferenceNotFound {
+				return plumbing.ZeroHash, permanentError{fmt.Errorf("failed to resolve revision %v: %v", r.Label, err)}
+			}
+			return plumbing.ZeroHash, fmt.Errorf("failed to resolve revision %v: %v", r.Label, err)
+		}
+		return *hash, nil
+	}
 
 	var ref string
 	if r.LabelType == "tag" {
 		ref = "refs/tags/" + r.Label
 	} else {
-		ref = "refs/heads/" + r.Label
+		ref = "refs/remotes/" + remote + "/" + r.Label
+	}
+	remoteRef, err := repo.Reference(plumbing.ReferenceName(ref), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, permanentError{fmt.Errorf("failed to get reference for %s: %v", ref, err)}
 	}
-
-	rlog.Debugf("Clone reference: %v", ref)
-
-	// checkout specific branch / tag
-	_, err = git.PlainClone(r.Directory, false, &git.CloneOptions{
-		URL:           r.URL,
-		ReferenceName: plumbing.ReferenceName(ref),
-		Auth:          sshAuth,
-	})
-
 	if err != nil {
-		rlog.Errorf("Failed to clone repository: %v", err)
-		return
+		return plumbing.ZeroHash, fmt.Errorf("failed to get reference for %s: %v", ref, err)
 	}
 
-	rlog.Info("Cloned repository")
+	// annotated tags point at the tag object, we want the commit it tags
+	if atag, err := repo.TagObject(remoteRef.Hash()); err == nil {
+		log.WithField("repo", r.Name()).Debugf("Annotated tag %v targets %v", atag.Hash, atag.Target)
+		return atag.Target, nil
+	}
+	return remoteRef.Hash(), nil
+}
 
-	r.touchTrigger()
+// IsFrozen is true when the label is an exact commit or revision, pushes only
+// fetch and never move the work tree.
+func (r *repo) IsFrozen() bool {
+	return r.LabelType == "commit" || r.LabelType == "revision"
 }
 
 // essentially git fetch and git reset --hard origin/master | latest remote commit
-func (r *repo) update() {
-	defer r.finished()
+func (r *repo) update(j *job) {
 	rlog := log.WithFields(logrus.Fields{
 		"repo":      r.Name(),
 		"path":      r.Path,
-		"remote":    r.Remote,
 		"label":     r.Label,
 		"labelType": r.LabelType,
 	})
 
-	r.waitForCompletion()
-	r.Busy = true
-	sshAuth, err := ssh.NewPublicKeysFromFile("git", r.SSHPrivKey, r.SSHPassPhrase)
-	if err != nil {
-		rlog.Errorf("Failed to setup ssh auth: %v", err)
+	d := r.newDeployment(j)
+	defer d.save()
+
+	if p, ok := r.pinned(); ok {
+		rlog.Warnf("Repo is pinned at %v, holding update until it is unpinned", shortSHA(p.SHA))
+		d.hold()
 		return
 	}
 
+	// replace the local copy with a fresh clone, counts as a success if that
+	// works and the post update steps pass for the commit it ends up at
+	recoverRepo := func(cause error) {
+		d.fail(cause)
+		head, err := r.reclone(j.ctx, cause)
+		if err != nil {
+			return
+		}
+		d.recovered(head)
+		if err := r.afterDeploy(j.ctx, d); err != nil {
+			d.fail(err)
+		}
+	}
+
 	repo, err := git.PlainOpen(r.Directory)
 	if err != nil {
 		rlog.Errorf("Failed to open local git repository: %v", err)
+		// a missing or unreadable directory needs fixing by hand, and cloning
+		// would go behind initialise: false
+		if unreadable(err) {
+			d.fail(err)
+			return
+		}
+		recoverRepo(err)
 		return
 	}
 
 	w, err := repo.Worktree()
 	if err != nil {
 		rlog.Errorf("Failed to open work tree for repository: %v", err)
+		d.fail(err)
 		return
 	}
 
-	// fetches from github can be flaky, sometimes we get a blank .git/refs/remotes/[master|branch name],
-	// and complaints about broken refs, subsequent fetches should fix this!
-	// we'll fetch up to the retry amount until it succeeds!.
-
-	for i := 0; i < C.RetryCount; i++ {
-		rlog.Info("Fetch attempt: ", i+1)
-		err = repo.Fetch(&git.FetchOptions{
-			RemoteName: r.Remote,
-			Auth:       sshAuth,
-			Force:      true,
-			Tags:       git.AllTags,
-		})
-		if err == nil {
-			break
-		}
-		if err == git.NoErrAlreadyUpToDate {
-			rlog.Info("No new commits")
+	if err := r.ensureRemotes(repo); err != nil {
+		rlog.Error(err)
+		d.fail(err)
+		return
+	}
+
+	if head, err := repo.Head(); err == nil {
+		d.OldSHA = head.Hash().String()
+	}
+	vetoed, reason, err := r.preUpdate(j.ctx, d, j.sha)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	if vetoed {
+		rlog.Warnf("Update vetoed by preUpdate command: %v", reason)
+		d.veto(reason)
+		return
+	}
+
+	served, err := r.fetch(j.ctx, repo)
+	if err == git.NoErrAlreadyUpToDate {
+		rlog.WithField("remote", served.Name).Info("No new commits")
+		// a checkout still has to move the work tree to a changed label
+		if j.jobType != "checkout" {
+			d.skip()
 			return
 		}
-		if err != nil {
-			rlog.Errorf("Failed to fetch updates: %v", err)
-			time.Sleep(time.Duration(C.RetryDelay) * time.Second)
-			continue
+		err = nil
+	}
+	if err != nil {
+		// out of retries, if the local copy is broken no amount of fetching will
+		// fix it. verify once any abandoned fetch has stopped writing to it.
+		vctx, cancel := context.WithTimeout(j.ctx, r.fetchTimeout())
+		verr := run(vctx, r.Directory, func() error { return verify(repo) })
+		busy := vctx.Err() != nil
+		cancel()
+		if verr != nil && !busy {
+			rlog.Errorf("Local repository failed verification: %v", verr)
+			recoverRepo(fmt.Errorf("%v (fetch: %v)", verr, err))
+			return
 		}
+		d.fail(err)
+		return
 	}
+	d.Remote = served.Name
+	rlog = rlog.WithField("remote", served.Name)
 	rlog.Info("Fetched new updates")
 
-	var ref string
-	if r.LabelType == "tag" {
-		ref = "refs/tags/" + r.Label
-	} else {
-		ref = "refs/remotes/" + r.Remote + "/" + r.Label
+	// commit / revision labels only move when the label in the config changes
+	if r.IsFrozen() && j.jobType != "checkout" {
+		rlog.Infof("Work tree is frozen at %v, fetched objects only", r.Label)
+		d.skip()
+		return
 	}
 
+	policy := r.retryPolicy()
 	var targetHash plumbing.Hash
-	remoteRef, err := repo.Reference(plumbing.ReferenceName(ref), true)
+	err = policy.do(j.ctx, rlog, "resolve "+r.Label, func() (err error) {
+		targetHash, err = r.target(repo, served.Name)
+		return err
+	})
 	if err != nil {
-		rlog.Errorf("Failed to get reference for %s: %v", ref, err)
+		if verr := verify(repo); verr != nil {
+			recoverRepo(verr)
+			return
+		}
+		d.fail(err)
 		return
 	}
 
-	targetHash = remoteRef.Hash()
-
-	// test if annotated tag and amend targetHash
-	if atag, err := repo.TagObject(remoteRef.Hash()); err == nil {
-		rlog.Infof("Annotated tag hash: %v", atag.Hash)
-		rlog.Infof("Annotated tag target hash: %v", atag.Target)
-		targetHash = atag.Target
-	}
-
-	localRef, err := repo.Reference(plumbing.ReferenceName("HEAD"), true)
+	var localRef *plumbing.Reference
+	err = policy.do(j.ctx, rlog, "get local reference for HEAD", func() (err error) {
+		localRef, err = repo.Reference(plumbing.HEAD, true)
+		return err
+	})
 	if err != nil {
-		rlog.Errorf("Failed to get local reference for HEAD: %v", err)
+		recoverRepo(err)
 		return
 	}
+	d.OldSHA = localRef.Hash().String()
 
-	if remoteRef.Hash() == localRef.Hash() {
+	if targetHash == localRef.Hash() {
 		rlog.Warning("Already up to date")
+		d.skip()
 		return
 	}
 
 	// git reset --hard [origin/master|hash] - works for both branch and tag, we'll reset direct to the hash
-	err = w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: targetHash})
+	err = policy.do(j.ctx, rlog, "hard reset work tree", func() error {
+		return w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: targetHash})
+	})
 	if err != nil {
-		rlog.Errorf("Failed to hard reset work tree: %v", err)
+		d.fail(err)
 		return
 	}
 	rlog.Info("Hard reset successful, confirming changes....")
 	headRef, err := repo.Reference(plumbing.ReferenceName("HEAD"), true)
 	if err != nil {
 		rlog.Errorf("Failed to get local HEAD reference: %v", err)
+		d.fail(err)
 		return
 	}
 
@@ -262,32 +415,22 @@ func (r *repo) update() {
 		rlog.Error("Something went wrong, hashes don't match!")
 		rlog.Debugf("Remote hash: %v", targetHash)
 		rlog.Debugf("Local hash:  %v", headRef.Hash())
+		d.fail(fmt.Errorf("hashes don't match, expected %v got %v", targetHash, headRef.Hash()))
 		return
 	}
 
-	r.touchTrigger()
-}
+	if err := r.deploy(repo, targetHash); err != nil {
+		rlog.Error(err)
+		d.fail(err)
+		return
+	}
+	d.succeed(targetHash)
 
-func (r *repo) touchTrigger() {
-	rlog := log.WithFields(logrus.Fields{
-		"repo":      r.Name(),
-		"path":      r.Path,
-		"label":     r.Label,
-		"labelType": r.LabelType,
-	})
-	if r.HasTrigger() {
-		if err := os.Chtimes(r.Trigger, time.Now(), time.Now()); err != nil {
-			rlog.Errorf("Failed to update trigger file: %v, attempting to create...", err)
-
-			// attempt to create trigger file silently, reports error but creates empty file
-			os.OpenFile(r.Trigger, os.O_RDONLY|os.O_CREATE, 0660)
-			if _, err := os.Stat(r.Trigger); err != nil {
-				rlog.Errorf("Failed to create trigger file: %v", err)
-			}
-			rlog.Info("Successfully created trigger file")
-			return
+	if err := r.afterDeploy(j.ctx, d); err != nil {
+		d.fail(err)
+		if r.AutoRollback {
+			r.autoRollback(repo, d, err)
 		}
-		rlog.Info("Successfully updated trigger file")
 	}
 }
 
@@ -329,21 +472,11 @@ func (r *repo) HasSecret() bool {
 	return true
 }
 
-func process(jobs chan *job, threads int) {
-	sem := make(chan struct{}, threads)
+func process(jobs chan *job) {
 	for {
 		select {
 		case j := <-jobs:
-			go func() {
-				sem <- struct{}{}
-				switch j.jobType {
-				case "clone":
-					j.repo.clone()
-				case "update":
-					j.repo.update()
-				}
-				<-sem
-			}()
+			sched.submit(j)
 		}
 	}
 
@@ -351,13 +484,14 @@ func process(jobs chan *job, threads int) {
 
 func (p *DataPasser) handleFunc(w http.ResponseWriter, r *http.Request) {
 	//func handler(w http.ResponseWriter, r *http.Request) {
-	idx, ok := C.FindRepo(r.URL.Path)
+	c := conf()
+	idx, ok := c.FindRepo(r.URL.Path)
 	if !ok {
 		log.Warnf("Repository not found for path: %v", r.URL.Path)
 		return
 	}
 
-	payload, err := github.ValidatePayload(r, []byte(C.Repos[idx].Secret))
+	payload, err := github.ValidatePayload(r, []byte(c.Repos[idx].Secret))
 	defer r.Body.Close()
 	if err != nil {
 		log.Errorf("Error validating request body: %v", err)
@@ -372,8 +506,16 @@ func (p *DataPasser) handleFunc(w http.ResponseWriter, r *http.Request) {
 
 	switch e := event.(type) {
 	case *github.PushEvent:
-		if C.Repos[idx].URL == *e.Repo.SSHURL && (C.Repos[idx].Label == strings.TrimPrefix(*e.Ref, "refs/heads/") || C.Repos[idx].Label == strings.TrimPrefix(*e.Ref, "refs/tags/")) {
-			p.jobs <- &job{repo: &C.Repos[idx], jobType: "update"}
+		if c.Repos[idx].URL == *e.Repo.SSHURL && (c.Repos[idx].IsFrozen() || c.Repos[idx].Label == strings.TrimPrefix(*e.Ref, "refs/heads/") || c.Repos[idx].Label == strings.TrimPrefix(*e.Ref, "refs/tags/")) {
+			j := newJob(&c.Repos[idx], "update")
+			j.delivery = github.DeliveryID(r)
+			j.pusher = e.GetPusher().GetName()
+			j.sha = e.GetAfter()
+			j.payload = payload
+			// on disk before github gets its response, it won't redeliver
+			journalJob(j)
+			p.jobs <- j
+			writeJSON(w, http.StatusAccepted, map[string]string{"job": j.id})
 		} else {
 			log.WithFields(logrus.Fields{
 				"URL": *e.Repo.SSHURL,
@@ -398,18 +540,53 @@ func (c *config) setRepoDefaults() {
 		if c.Repos[i].Remote == "" {
 			c.Repos[i].Remote = "origin"
 		}
+		c.Repos[i].setRemoteDefaults()
+		if c.Repos[i].DeployMode == "" {
+			c.Repos[i].DeployMode = "inplace"
+		}
+		// releases and current live next to the clone, named after it so
+		// repos sharing a parent directory don't share them too
+		if c.Repos[i].ReleaseDir == "" {
+			c.Repos[i].ReleaseDir = filepath.Clean(c.Repos[i].Directory) + ".releases"
+		}
+		if c.Repos[i].CurrentLink == "" {
+			c.Repos[i].CurrentLink = filepath.Clean(c.Repos[i].Directory) + ".current"
+		}
+		if c.Repos[i].KeepReleases <= 0 {
+			c.Repos[i].KeepReleases = 5
+		}
 	}
 }
 
 func (c *config) validateLabelType() {
+	valid := c.Repos[:0]
 	for i := range c.Repos {
 		// either known or blank, if blank our setRepoDefaults function will set
-		if c.Repos[i].LabelType == "branch" || c.Repos[i].LabelType == "tag" || c.Repos[i].LabelType == "" {
-			continue
-		} else {
-			log.Warnf("Unknown label type for repo: %s, defaulting to branch", c.Repos[i].Name)
+		switch c.Repos[i].LabelType {
+		case "branch", "tag", "revision", "":
+		case "commit":
+			// anything else would check out a garbage hash
+			if len(c.Repos[i].Label) != 40 || plumbing.NewHash(c.Repos[i].Label).String() != strings.ToLower(c.Repos[i].Label) {
+				log.Errorf("Label for repo: %s must be a full commit sha when labelType is commit, ignoring the repo", c.Repos[i].Name())
+				continue
+			}
+		default:
+			log.Warnf("Unknown label type for repo: %s, defaulting to branch", c.Repos[i].Name())
+			c.Repos[i].LabelType = "branch"
 		}
+		valid = append(valid, c.Repos[i])
+	}
+	c.Repos = valid
+}
 
+func (c *config) validateDeployMode() {
+	for i := range c.Repos {
+		switch c.Repos[i].DeployMode {
+		case "inplace", "release", "":
+		default:
+			log.Warnf("Unknown deploy mode for repo: %s, defaulting to inplace", c.Repos[i].Name())
+			c.Repos[i].DeployMode = "inplace"
+		}
 	}
 }
 
@@ -469,9 +646,23 @@ func (c *config) refreshTasks() {
 	c.setLogging()
 	c.validatePathsUniq()
 	c.validateLabelType()
+	c.validateDeployMode()
+	c.validateTriggerFormat()
+	c.validateHealthChecks()
+	c.validateReloads()
+	c.validateCallbacks()
+	c.validateNotifiers()
 	c.setRepoDefaults()
-	// TODO: respawn process()
-	c.DataPasser.threads = c.Threads
+	c.validateReleases()
+	c.setRetryDefaults()
+	if c.Threads < 1 {
+		log.Errorf("Invalid threads %v, using 1", c.Threads)
+		c.Threads = 1
+	}
+	// queued jobs stay queued, the pool grows or shrinks around them
+	if sched != nil {
+		sched.resize(c.Threads)
+	}
 	c.LastUpdate = time.Now()
 }
 
@@ -479,129 +670,112 @@ func (c *config) initialClone() {
 	if c.Initialise {
 		for idx, r := range c.Repos {
 			if _, err := os.Stat(r.Directory); err != nil {
-				c.DataPasser.jobs <- &job{repo: &c.Repos[idx], jobType: "clone"}
+				c.DataPasser.jobs <- newJob(&c.Repos[idx], "clone")
+			} else if r.IsFrozen() {
+				// make sure the work tree is at the (possibly changed) commit / revision
+				c.DataPasser.jobs <- newJob(&c.Repos[idx], "checkout")
 			}
 		}
 	}
 
 }
 
+// setDefaults sets the config defaults on v
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("listen", "0.0.0.0")
+	v.SetDefault("port", 5555)
+	v.SetDefault("retry_delay", 10)
+	v.SetDefault("retry_count", 1)
+	v.SetDefault("threads", 5)
+	v.SetDefault("initialise", true)
+	v.SetDefault("logging.format", "text")
+	v.SetDefault("logging.output", "stdout")
+	v.SetDefault("logging.level", "info")
+	v.SetDefault("logging.timestamp", true)
+	v.SetDefault("data_dir", "/var/lib/gwg")
+	v.SetDefault("clone_timeout", 600)
+	v.SetDefault("fetch_timeout", 300)
+	v.SetDefault("drain_timeout", 60)
+	v.SetDefault("reconcile_on_start", true)
+}
+
 func main() {
 	// setup config
 	viper.SetConfigName("config")
 	viper.AddConfigPath("/etc/gwg")
 	viper.AddConfigPath(".")
-
-	viper.SetDefault("listen", "0.0.0.0")
-	viper.SetDefault("port", 5555)
-	viper.SetDefault("retry_delay", 10)
-	viper.SetDefault("retry_count", 1)
-	viper.SetDefault("threads", 5)
-	viper.SetDefault("initialise", true)
-	viper.SetDefault("logging.format", "text")
-	viper.SetDefault("logging.output", "stdout")
-	viper.SetDefault("logging.level", "info")
-	viper.SetDefault("logging.timestamp", true)
+	setDefaults(viper.GetViper())
 
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatalf("Failed to read config file: %v", err)
 	}
-	if err := viper.Unmarshal(&C); err != nil {
+	var c config
+	if err := viper.Unmarshal(&c); err != nil {
 		log.Fatalf("Failed to setup configuration: %v", err)
 	}
 
-	signalCh := make(chan os.Signal)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-signalCh
-		var busy bool
-		log.Println("Signal received, preparing to shutting down...")
-		for {
-			// will C update on hot reload???
-			busy = false
-
-			// make a copy each loop so it gets new versions
-			repos := C.Repos
-			for _, r := range repos {
-				if r.Busy {
-					busy = true
-				}
-			}
-			if busy {
-				log.Warnln("Repo updates are still in progress (waiting to safely shutdown)...")
-				time.Sleep(5 * time.Second)
-			} else {
-				log.Println("Shutting down GWG!")
-				os.Exit(0)
-			}
-		}
-	}()
+	// subcommands work against the same config and data directory as the server
+	if len(os.Args) > 1 {
+		c.setRepoDefaults()
+		current.Store(&c)
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	sched = newScheduler(c.Threads)
 
 	passer := &DataPasser{
-		jobs:    make(chan *job, 100),
-		threads: C.Threads,
+		jobs: make(chan *job, 100),
 	}
 
-	C.DataPasser = passer
+	c.DataPasser = passer
 
-	C.refreshTasks()
+	c.refreshTasks()
+	current.Store(&c)
 
 	viper.WatchConfig()
 	// event fired twice on linux but once on mac? wtf!!!
 	viper.OnConfigChange(func(e fsnotify.Event) {
-		mutex.Lock()
-		if time.Since(C.LastUpdate).Nanoseconds() < 250229410 {
+		if time.Since(conf().LastUpdate).Nanoseconds() < 250229410 {
 			return
 		}
-
-		// create entirely new config, set defaults and change 'C'
-		// yaml and toml differences in repo mappings means we have to unmarshal
-		// everything first.
-		var newC config
-		if err := viper.Unmarshal(&newC); err != nil {
-			log.Fatalf("Failed to setup new configuration: %v", err)
-		}
-
 		log.Warnf("Config file changed: %v", e.Name)
 		log.Debugf("Event: %v", e.Op)
-		newC.DataPasser = passer
-		newC.refreshTasks()
-
-		// wait until repos are finished updating / cloning
-		for {
-			// will C update on hot reload???
-			repoBusy := false
-
-			// make a copy each loop so it gets new versions
-			repos := C.Repos
-			for _, r := range repos {
-				if r.Busy {
-					repoBusy = true
-				}
-			}
-			if repoBusy {
-				log.Println("Repo updates are still in progress (waiting to safely update configuration)...")
-				time.Sleep(5 * time.Second)
-			} else {
-				log.Println("Replacing configuration...")
-				// replace current config with new one
-				C = newC
-				break
-			}
-		}
-
-		mutex.Unlock()
-		log.Warn("Configuration updated")
+		reloadConfig(passer, viper.GetViper())
 	})
 
-	go process(passer.jobs, passer.threads)
+	go process(passer.jobs)
+	go sendNotifications()
 
-	C.initialClone()
+	// deliveries that hadn't finished when we last stopped
+	replayJournal()
+	c.initialClone()
+	c.startReconcilers()
+	if c.ReconcileOnStart {
+		// catch up on pushes missed while we were down
+		go c.reconcileAll()
+	}
 
 	// Start the server.
 	// (listen and port changes require a restart)
 	//http.HandleFunc("/", handler)
 	http.HandleFunc("/", passer.handleFunc)
-	http.ListenAndServe(C.Listen+":"+C.Port, nil)
+	http.HandleFunc("/api/history", handleHistory)
+	http.HandleFunc("/api/rollback", handleRollback)
+	http.HandleFunc("/api/unpin", handleUnpin)
+	http.HandleFunc("/api/cancel", handleCancel)
+	http.HandleFunc("/api/jobs", handleJobs)
+	http.HandleFunc("/api/jobs/", handleJob)
+	http.HandleFunc("/api/queue", handleQueue)
+	http.HandleFunc("/api/dead", handleDead)
+	http.HandleFunc("/api/dead/", handleDeadLetter)
+	http.HandleFunc("/api/dead/retry", handleDeadRetry)
+	http.HandleFunc("/api/dead/discard", handleDeadDiscard)
+	srv := &http.Server{Addr: c.Listen + ":" + c.Port}
+	go handleSignals(srv, passer)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	// shutting down, handleSignals exits once jobs have drained
+	select {}
 
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+)
+
+// mirror is a bare copy of an upstream shared by every repo cloned from it
+type mirror struct {
+	sync.Mutex
+	refreshed time.Time // when the last successful refresh started
+}
+
+var mirrors = struct {
+	sync.Mutex
+	m map[string]*mirror
+}{m: make(map[string]*mirror)}
+
+var unsafePath = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func useMirrors() bool {
+	return !isEmpty(conf().MirrorDir)
+}
+
+// mirrorPath is where the bare mirror for an upstream url lives
+func mirrorPath(url string) string {
+	return filepath.Join(conf().MirrorDir, unsafePath.ReplaceAllString(url, "_")+".git")
+}
+
+// fetchURL is where the repo fetches the remote from, the local mirror when enabled
+func (rm *remote) fetchURL() string {
+	if useMirrors() {
+		return mirrorPath(rm.URL)
+	}
+	return rm.URL
+}
+
+func getMirror(path string) *mirror {
+	mirrors.Lock()
+	defer mirrors.Unlock()
+	m, ok := mirrors.m[path]
+	if !ok {
+		m = &mirror{}
+		mirrors.m[path] = m
+	}
+	return m
+}
+
+// refreshMirror fetches the remote's upstream into its bare mirror, creating
+// it if needed. A refresh that started after since has already picked up
+// anything we were asked to fetch, so concurrent updates of repos sharing an
+// upstream only fetch it once.
+func refreshMirror(ctx context.Context, rm *remote, since time.Time) error {
+	path := mirrorPath(rm.URL)
+	m := getMirror(path)
+	m.Lock()
+	defer m.Unlock()
+
+	mlog := log.WithFields(logrus.Fields{
+		"mirror": path,
+		"url":    rm.URL,
+	})
+	if m.refreshed.After(since) {
+		mlog.Debug("Mirror already refreshed")
+		return nil
+	}
+
+	start := time.Now()
+	repo, err := git.PlainOpen(path)
+	if err == git.ErrRepositoryNotExists {
+		mlog.Info("Creating mirror")
+		repo, err = git.PlainInit(path, true)
+		if err == nil {
+			_, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+				Name:  "origin",
+				URLs:  []string{rm.URL},
+				Fetch: []gitconfig.RefSpec{"+refs/heads/*:refs/heads/*"},
+			})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open mirror %v: %v", path, err)
+	}
+
+	auth, err := rm.auth()
+	if err != nil {
+		return err
+	}
+	// the mirror stays locked until an abandoned fetch has finished
+	err = run(ctx, path, func() error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			Auth:  auth,
+			Force: true,
+			Tags:  git.AllTags,
+		})
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		if permanent(err) {
+			// wrapped, so keep it recognisable to the retry policy
+			return permanentError{fmt.Errorf("failed to refresh mirror: %v", err)}
+		}
+		return fmt.Errorf("failed to refresh mirror: %v", err)
+	}
+	m.refreshed = start
+	mlog.Info("Refreshed mirror")
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefreshMirrorPermanentErrors(t *testing.T) {
+	mirrorDir := t.TempDir()
+	setConf(t, func(c *config) { c.MirrorDir = mirrorDir })
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	for name, rm := range map[string]*remote{
+		"unknown repository": {Name: "origin", URL: missing},
+		"missing ssh key":    {Name: "origin", URL: "ssh://git@example.com/a/b.git", SSHPrivKey: missing},
+	} {
+		err := refreshMirror(context.Background(), rm, time.Time{})
+		if err == nil || !permanent(err) {
+			t.Errorf("%v: got %v, want a permanent error", name, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// notifier sends a message to slack, teams, discord or by email when a job
+// finishes or the config is reloaded
+type notifier struct {
+	Type     string   `mapstructure:"type"`     // slack, teams, discord or email
+	URL      string   `mapstructure:"url"`      // incoming webhook url
+	Events   []string `mapstructure:"events"`   // success, failure, skipped, rollback and / or reload, defaults to failure and rollback
+	Repos    []string `mapstructure:"repos"`    // repo names or paths, blank for every repo
+	Template string   `mapstructure:"template"` // go text/template for the message, fields as in notification
+	Timeout  float64  `mapstructure:"timeout"`  // seconds per attempt, defaults to 10
+	SMTP     string   `mapstructure:"smtp"`     // email only, host:port
+	Username string   `mapstructure:"username"` // email only, blank for no auth
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+	Subject  string   `mapstructure:"subject"` // template for the subject line
+
+	message *template.Template
+	subject *template.Template
+}
+
+// notification is what the templates are given
+type notification struct {
+	Event        string // success, failure, skipped, rollback or reload
+	Host         string
+	Time         time.Time
+	Repo         string
+	Path         string
+	Job          string
+	Type         string // job type, clone, update, checkout or rollback
+	State        string // job state
+	Ref          string
+	OldSHA       string
+	NewSHA       string
+	Delivery     string
+	Pusher       string
+	Duration     time.Duration
+	Error        string
+	Reason       string
+	RolledBackTo string
+}
+
+const defaultMessage = `{{if eq .Event "reload"}}gwg on {{.Host}}: configuration {{if .Error}}reload failed: {{.Error}}{{else}}reloaded{{end}}` +
+	`{{else}}gwg on {{.Host}}: {{.Type}} of {{.Repo}} {{.State}}{{with .OldSHA}} {{short .}}{{end}}{{with .NewSHA}} -> {{short .}}{{end}}` +
+	`{{with .RolledBackTo}}, rolled back to {{short .}}{{end}}{{with .Pusher}} (pushed by {{.}}){{end}}{{with .Error}}: {{.}}{{end}}{{with .Reason}}: {{.}}{{end}}{{end}}`
+
+const defaultSubject = `gwg: {{if eq .Event "reload"}}configuration reload{{else}}{{.Repo}} {{.State}}{{end}}`
+
+var templateFuncs = template.FuncMap{"short": shortSHA}
+
+var notifyEvents = map[string]bool{"success": true, "failure": true, "skipped": true, "rollback": true, "reload": true}
+
+// notifications queues messages for sendNotifications, so a slow endpoint
+// never holds up a worker
+var notifications = make(chan func(), 100)
+
+// validateNotifiers drops notifiers that can't work and parses their templates
+func (c *config) validateNotifiers() {
+	valid := c.Notifiers[:0]
+	for _, n := range c.Notifiers {
+		if err := n.prepare(); err != nil {
+			log.Errorf("Invalid %v notifier, ignoring it: %v", n.Type, err)
+			continue
+		}
+		valid = append(valid, n)
+	}
+	c.Notifiers = valid
+}
+
+// prepare checks the notifier, fills in defaults and parses its templates
+func (n *notifier) prepare() error {
+	switch n.Type {
+	case "slack", "teams", "discord":
+		if isEmpty(n.URL) {
+			return fmt.Errorf("no url")
+		}
+	case "email":
+		if isEmpty(n.SMTP) || isEmpty(n.From) || len(n.To) == 0 {
+			return fmt.Errorf("smtp, from and to are required")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, must be slack, teams, discord or email", n.Type)
+	}
+	if len(n.Events) == 0 {
+		n.Events = []string{"failure", "rollback"}
+	}
+	for _, e := range n.Events {
+		if !notifyEvents[e] {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	if n.Timeout <= 0 {
+		n.Timeout = 10
+	}
+	if n.Template == "" {
+		n.Template = defaultMessage
+	}
+	if n.Subject == "" {
+		n.Subject = defaultSubject
+	}
+	var err error
+	if n.message, err = template.New("message").Funcs(templateFuncs).Parse(n.Template); err != nil {
+		return err
+	}
+	n.subject, err = template.New("subject").Funcs(templateFuncs).Parse(n.Subject)
+	return err
+}
+
+// wants reports whether the notifier is interested in the event
+func (n *notifier) wants(e *notification) bool {
+	found := false
+	for _, ev := range n.Events {
+		if ev == e.Event {
+			found = true
+		}
+	}
+	if !found || e.Event == "reload" || len(n.Repos) == 0 {
+		return found
+	}
+	for _, id := range n.Repos {
+		if id == e.Repo || cleanURL(id) == e.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyEvent is the event a finished job counts as
+func notifyEvent(j *job, state string) string {
+	switch {
+	case state == "rolled-back", state == "succeeded" && j.jobType == "rollback":
+		return "rollback"
+	case state == "succeeded":
+		return "success"
+	case state == "failed":
+		return "failure"
+	}
+	// skipped, held, vetoed and cancelled
+	return "skipped"
+}
+
+// notify queues notifications for the finished job
+func (j *job) notify(state string) {
+	c := conf()
+	if j.result == nil || len(c.Notifiers) == 0 {
+		// never ran
+		return
+	}
+	d := j.result
+	notify(c.Notifiers, &notification{
+		Event:        notifyEvent(j, state),
+		Repo:         d.Repo,
+		Path:         d.Path,
+		Job:          j.id,
+		Type:         d.Type,
+		State:        state,
+		Ref:          d.Ref,
+		OldSHA:       d.OldSHA,
+		NewSHA:       d.NewSHA,
+		Delivery:     d.Delivery,
+		Pusher:       d.Pusher,
+		Duration:     d.End.Sub(d.Start),
+		Error:        d.Error,
+		Reason:       d.Reason,
+		RolledBackTo: d.RolledBackTo,
+	})
+}
+
+// notifyReload queues notifications for a config reload, err is why it failed
+func notifyReload(notifiers []notifier, err error) {
+	e := &notification{Event: "reload"}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	notify(notifiers, e)
+}
+
+// notify queues e for every interested notifier, dropping it if the queue's full
+func notify(notifiers []notifier, e *notification) {
+	e.Host, _ = os.Hostname()
+	e.Time = time.Now()
+	for i := range notifiers {
+		n := notifiers[i]
+		if !n.wants(e) {
+			continue
+		}
+		select {
+		case notifications <- func() { n.send(e) }:
+		default:
+			log.Warnf("Notification queue full, dropping %v notification for %v", n.Type, e.Event)
+		}
+	}
+}
+
+// sendNotifications sends queued notifications one at a time
+func sendNotifications() {
+	for send := range notifications {
+		send()
+	}
+}
+
+// send renders and sends a notification, retrying a couple of times
+func (n *notifier) send(e *notification) {
+	rlog := log.WithFields(logrus.Fields{
+		"notifier": n.Type,
+		"event":    e.Event,
+	})
+	if e.Repo != "" {
+		rlog = rlog.WithField("repo", e.Repo)
+	}
+	var msg, subject bytes.Buffer
+	if err := n.message.Execute(&msg, e); err != nil {
+		rlog.Errorf("Failed to render notification: %v", err)
+		return
+	}
+	if err := n.subject.Execute(&subject, e); err != nil {
+		rlog.Errorf("Failed to render notification subject: %v", err)
+		return
+	}
+
+	policy := retryPolicy{Attempts: 3, Delay: 2, Multiplier: 2, MaxDelay: 30}
+	err := policy.do(context.Background(), rlog, "send notification", func() error {
+		if n.Type == "email" {
+			return n.mail(subject.String(), msg.String())
+		}
+		return n.post(msg.String())
+	})
+	if err == nil {
+		rlog.Debug("Sent notification")
+	}
+}
+
+// post sends the message to an incoming webhook
+func (n *notifier) post(msg string) error {
+	var body interface{}
+	switch n.Type {
+	case "slack":
+		body = map[string]string{"text": msg}
+	case "teams":
+		body = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  msg,
+			"text":     msg,
+		}
+	case "discord":
+		// discord rejects messages over 2000 characters
+		if len(msg) > 2000 {
+			msg = msg[:1997] + "..."
+		}
+		body = map[string]string{"content": msg}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return permanentError{err}
+	}
+	client := &http.Client{Timeout: time.Duration(n.Timeout * float64(time.Second))}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("got status %v", resp.StatusCode)
+	}
+	return permanentError{fmt.Errorf("got status %v", resp.StatusCode)}
+}
+
+// mail sends the message by email, using STARTTLS when the server offers it
+func (n *notifier) mail(subject, msg string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", n.From)
+	fmt.Fprintf(&b, "To: %v\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&b, "Subject: %v\r\n", strings.Replace(subject, "\n", " ", -1))
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(msg, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+
+	// smtp.SendMail has no timeout, one hung server would hold up every notification
+	timeout := time.Duration(n.Timeout * float64(time.Second))
+	conn, err := net.DialTimeout("tcp", n.SMTP, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	host, _, _ := net.SplitHostPort(n.SMTP)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return permanentError{err}
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWebhook records the json bodies posted to it
+func fakeWebhook(t *testing.T) (*httptest.Server, <-chan map[string]string) {
+	bodies := make(chan map[string]string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %v with content type %q, want a json POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode body: %v", err)
+		}
+		bodies <- body
+	}))
+	t.Cleanup(srv.Close)
+	return srv, bodies
+}
+
+func TestNotifierBodies(t *testing.T) {
+	for _, c := range []struct {
+		kind string
+		want map[string]string
+	}{
+		{"slack", map[string]string{"text": "hello"}},
+		{"teams", map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  "hello",
+			"text":     "hello",
+		}},
+		{"discord", map[string]string{"content": "hello"}},
+	} {
+		srv, bodies := fakeWebhook(t)
+		n := &notifier{Type: c.kind, URL: srv.URL}
+		if err := n.prepare(); err != nil {
+			t.Fatalf("%v: %v", c.kind, err)
+		}
+		if err := n.post("hello"); err != nil {
+			t.Errorf("%v: %v", c.kind, err)
+			continue
+		}
+		got := <-bodies
+		if len(got) != len(c.want) {
+			t.Errorf("%v: got body %v, want %v", c.kind, got, c.want)
+		}
+		for k, v := range c.want {
+			if got[k] != v {
+				t.Errorf("%v: got %v %q, want %q", c.kind, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestDiscordTruncates(t *testing.T) {
+	srv, bodies := fakeWebhook(t)
+	n := &notifier{Type: "discord", URL: srv.URL}
+	if err := n.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.post(strings.Repeat("x", 2500)); err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-bodies)["content"]; len(got) != 2000 || !strings.HasSuffix(got, "...") {
+		t.Errorf("got %v characters ending %q, want 2000 ending ...", len(got), got[len(got)-3:])
+	}
+}
+
+func TestNotifierPostStatus(t *testing.T) {
+	for status, retried := range map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusNotFound:            false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		n := &notifier{Type: "slack", URL: srv.URL}
+		if err := n.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		err := n.post("hello")
+		srv.Close()
+		if err == nil || permanent(err) == retried {
+			t.Errorf("status %v: got %v, want retried %v", status, err, retried)
+		}
+	}
+}
+
+func TestNotifierSendsRenderedTemplate(t *testing.T) {
+	srv, bodies := fakeWebhook(t)
+	n := &notifier{
+		Type:     "slack",
+		URL:      srv.URL,
+		Template: "{{.Event}} {{.Repo}} {{short .NewSHA}} {{.Error}}",
+	}
+	if err := n.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	n.send(&notification{Event: "failure", Repo: "org/app", NewSHA: strings.Repeat("a", 40), Error: "boom"})
+	if got := (<-bodies)["text"]; got != "failure org/app aaaaaaa boom" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDefaultTemplates(t *testing.T) {
+	n := &notifier{Type: "slack", URL: "http://localhost"}
+	if err := n.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		e             notification
+		msg, subject string
+	}{
+		{
+			notification{Event: "failure", Host: "web1", Type: "update", Repo: "org/app", State: "failed",
+				OldSHA: strings.Repeat("a", 40), NewSHA: strings.Repeat("b", 40), Pusher: "jo", Error: "boom"},
+			"gwg on web1: update of org/app failed aaaaaaa -> bbbbbbb (pushed by jo): boom",
+			"gwg: org/app failed",
+		},
+		{
+			notification{Event: "rollback", Host: "web1", Type: "update", Repo: "org/app", State: "rolled-back",
+				NewSHA: strings.Repeat("b", 40), RolledBackTo: strings.Repeat("a", 40), Reason: "health check failed"},
+			"gwg on web1: update of org/app rolled-back -> bbbbbbb, rolled back to aaaaaaa: health check failed",
+			"gwg: org/app rolled-back",
+		},
+		{
+			notification{Event: "reload", Host: "web1"},
+			"gwg on web1: configuration reloaded",
+			"gwg: configuration reload",
+		},
+		{
+			notification{Event: "reload", Host: "web1", Error: "bad yaml"},
+			"gwg on web1: configuration reload failed: bad yaml",
+			"gwg: configuration reload",
+		},
+	} {
+		var msg, subject strings.Builder
+		if err := n.message.Execute(&msg, &c.e); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.subject.Execute(&subject, &c.e); err != nil {
+			t.Fatal(err)
+		}
+		if msg.String() != c.msg {
+			t.Errorf("got message %q, want %q", msg.String(), c.msg)
+		}
+		if subject.String() != c.subject {
+			t.Errorf("got subject %q, want %q", subject.String(), c.subject)
+		}
+	}
+}
+
+func TestNotifierPrepare(t *testing.T) {
+	for _, n := range []notifier{
+		{Type: "pager", URL: "http://localhost"},
+		{Type: "slack"},
+		{Type: "email", SMTP: "localhost:25", From: "gwg@example.com"},
+		{Type: "slack", URL: "http://localhost", Events: []string{"explosion"}},
+		{Type: "slack", URL: "http://localhost", Template: "{{.Nope"},
+	} {
+		n := n
+		if err := n.prepare(); err == nil {
+			t.Errorf("%+v: prepared without an error", n)
+		}
+	}
+
+	n := notifier{Type: "teams", URL: "http://localhost"}
+	if err := n.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(n.Events, ",") != "failure,rollback" || n.Timeout != 10 {
+		t.Errorf("got events %v and timeout %v, want failure,rollback and 10", n.Events, n.Timeout)
+	}
+}
+
+func TestNotifierWants(t *testing.T) {
+	n := &notifier{Events: []string{"failure", "reload"}, Repos: []string{"org/app", "/hooks/other/"}}
+	for _, c := range []struct {
+		e    notification
+		want bool
+	}{
+		{notification{Event: "failure", Repo: "org/app"}, true},
+		{notification{Event: "failure", Repo: "org/else", Path: "/hooks/other"}, true},
+		{notification{Event: "failure", Repo: "org/else", Path: "/hooks/else"}, false},
+		{notification{Event: "success", Repo: "org/app"}, false},
+		// reloads aren't about a repo
+		{notification{Event: "reload"}, true},
+	} {
+		if got := n.wants(&c.e); got != c.want {
+			t.Errorf("%v for %v %v: got %v, want %v", c.e.Event, c.e.Repo, c.e.Path, got, c.want)
+		}
+	}
+
+	all := &notifier{Events: []string{"success"}}
+	if !all.wants(&notification{Event: "success", Repo: "any/repo"}) {
+		t.Error("a notifier without repos didn't want every repo")
+	}
+}
+
+func TestNotifyDropsWhenFull(t *testing.T) {
+	// drain whatever's left afterwards, nothing sends in tests
+	defer func() {
+		for len(notifications) > 0 {
+			<-notifications
+		}
+	}()
+
+	n := notifier{Type: "slack", URL: "http://localhost", Events: []string{"failure"}}
+	if err := n.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	// not interested, never queued
+	notify([]notifier{n}, &notification{Event: "success"})
+	if len(notifications) != 0 {
+		t.Fatalf("got %v queued for an unwanted event", len(notifications))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(notifications)+10; i++ {
+			notify([]notifier{n}, &notification{Event: "failure"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify blocked on a full queue")
+	}
+	if len(notifications) != cap(notifications) {
+		t.Errorf("got %v queued, want %v", len(notifications), cap(notifications))
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// repoQueue serialises a repo's jobs, at most one running and one pending
+type repoQueue struct {
+	running *job
+	pending *job
+}
+
+// scheduler runs jobs on a bounded number of workers, one job per repo at a
+// time. Jobs for a repo that's busy wait as its pending job, further jobs are
+// folded into the pending one.
+type scheduler struct {
+	mu      sync.Mutex
+	idle    *sync.Cond // broadcast whenever a repo runs out of jobs
+	slots   *sync.Cond // broadcast whenever a worker is freed, threads changes or a job starts waiting
+	queues  map[string]*repoQueue
+	threads int            // max jobs running at once
+	active  int            // jobs running
+	hosts   map[string]int // jobs running per remote host
+	waiting []*job         // jobs waiting for a worker, in arrival order
+}
+
+var sched *scheduler
+
+func newScheduler(threads int) *scheduler {
+	s := &scheduler{
+		queues:  make(map[string]*repoQueue),
+		threads: threads,
+		hosts:   make(map[string]int),
+	}
+	s.idle = sync.NewCond(&s.mu)
+	s.slots = sync.NewCond(&s.mu)
+	return s
+}
+
+// resize changes the number of workers, growing takes effect straight away,
+// shrinking as running jobs finish
+func (s *scheduler) resize(threads int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if threads == s.threads {
+		return
+	}
+	log.Warnf("Resizing worker pool from %v to %v threads", s.threads, threads)
+	s.threads = threads
+	s.slots.Broadcast()
+}
+
+// hostLimit is the max number of jobs to run at once against a host, 0 for no limit
+func hostLimit(host string) int {
+	if host == "" {
+		return 0
+	}
+	c := conf()
+	if n, ok := c.HostLimits[host]; ok {
+		return n
+	}
+	return c.HostThreads
+}
+
+// next picks the waiting job to run next, must hold s.mu. The highest
+// priority job whose host isn't at its limit wins, oldest first.
+func (s *scheduler) next() *job {
+	if s.active >= s.threads {
+		return nil
+	}
+	var best *job
+	for _, j := range s.waiting {
+		if limit := hostLimit(j.host); limit > 0 && s.hosts[j.host] >= limit {
+			continue
+		}
+		if best == nil || j.repo.Priority > best.repo.Priority {
+			best = j
+		}
+	}
+	return best
+}
+
+// acquire blocks until j's turn for a worker
+func (s *scheduler) acquire(j *job) {
+	s.mu.Lock()
+	s.waiting = append(s.waiting, j)
+	s.slots.Broadcast()
+	for s.next() != j {
+		s.slots.Wait()
+	}
+	for i := range s.waiting {
+		if s.waiting[i] == j {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+	s.active++
+	s.hosts[j.host]++
+	// there may be room for the next one too
+	s.slots.Broadcast()
+	s.mu.Unlock()
+}
+
+// release frees j's worker
+func (s *scheduler) release(j *job) {
+	s.mu.Lock()
+	s.active--
+	s.hosts[j.host]--
+	if s.hosts[j.host] == 0 {
+		delete(s.hosts, j.host)
+	}
+	s.slots.Broadcast()
+	s.mu.Unlock()
+}
+
+// slot runs fn on a worker as if it were one of r's jobs against host, for
+// work outside the repo's queue that should still count against threads and
+// host_threads
+func (s *scheduler) slot(r *repo, host string, fn func()) {
+	j := &job{repo: r, host: host}
+	s.acquire(j)
+	defer s.release(j)
+	fn()
+}
+
+// jobRank orders job types when folding, the stronger type wins
+var jobRank = map[string]int{
+	"update":   0,
+	"checkout": 1,
+	"clone":    2,
+	"rollback": 3,
+}
+
+// submit queues a job, it runs straight away unless the repo is busy
+func (s *scheduler) submit(j *job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.ctx, j.cancel = context.WithValue(ctx, attemptLogKey{}, &j.attempts), cancel
+	j.finished = make(chan struct{})
+	if len(j.repo.Remotes) > 0 {
+		j.host = j.repo.Remotes[0].host()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queues[j.repo.Path]
+	if !ok {
+		q = &repoQueue{}
+		s.queues[j.repo.Path] = q
+	}
+
+	switch {
+	case q.running == nil:
+		q.running = j
+		go s.run(j)
+	case q.pending == nil:
+		q.pending = j
+	default:
+		q.pending = fold(q.pending, j)
+	}
+}
+
+// fold merges j into the pending job p and returns the job left pending. The
+// pending job always ends up targeting the latest push.
+func fold(p, j *job) *job {
+	rlog := log.WithFields(logrus.Fields{
+		"repo": j.repo.Name(),
+		"path": j.repo.Path,
+	})
+
+	// a rollback pins the repo, so updates would only be held anyway
+	if j.jobType == "rollback" || p.jobType == "rollback" {
+		keep, drop := j, p
+		if j.jobType != "rollback" {
+			keep, drop = p, j
+		}
+		rlog.Warnf("Dropping %v job %v in favour of pending %v job %v", drop.jobType, drop.id, keep.jobType, keep.id)
+		drop.err = errSuperseded
+		drop.done()
+		return keep
+	}
+
+	if jobRank[j.jobType] > jobRank[p.jobType] {
+		p.jobType = j.jobType
+	}
+	if !isEmpty(j.delivery) {
+		p.delivery = j.delivery
+		p.pusher = j.pusher
+		p.sha = j.sha
+		p.payload = j.payload
+	}
+	j.foldedInto(p)
+	journalFold(p, j)
+	rlog.Infof("Job %v already pending, folded in job %v, now targeting %v", p.id, j.id, shortSHA(p.sha))
+	j.release()
+	return p
+}
+
+// run works through the repo's jobs, starting with j, until none are pending
+func (s *scheduler) run(j *job) {
+	for j != nil {
+		s.acquire(j)
+		if j.ctx.Err() == nil {
+			j.started()
+			j.execute()
+		}
+		s.release(j)
+		j.done()
+
+		s.mu.Lock()
+		q := s.queues[j.repo.Path]
+		q.running, q.pending = q.pending, nil
+		j = q.running
+		if j == nil {
+			s.idle.Broadcast()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// busy reports whether any job is running or pending, must hold s.mu
+func (s *scheduler) busy() bool {
+	for _, q := range s.queues {
+		if q.running != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until every repo has run out of jobs
+func (s *scheduler) wait() {
+	s.mu.Lock()
+	for s.busy() {
+		s.idle.Wait()
+	}
+	s.mu.Unlock()
+}
+
+// cancel cancels the repo's running job and drops its pending one, returning
+// how many jobs were affected
+func (s *scheduler) cancel(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queues[path]
+	if !ok {
+		return 0
+	}
+	n := 0
+	if q.pending != nil {
+		q.pending.err = context.Canceled
+		q.pending.done()
+		q.pending = nil
+		n++
+	}
+	if q.running != nil {
+		q.running.cancel()
+		n++
+	}
+	return n
+}
+
+// cancelAll cancels every repo's jobs
+func (s *scheduler) cancelAll() int {
+	s.mu.Lock()
+	var paths []string
+	for path := range s.queues {
+		paths = append(paths, path)
+	}
+	s.mu.Unlock()
+
+	n := 0
+	for _, path := range paths {
+		n += s.cancel(path)
+	}
+	return n
+}
+
+// queueMetrics is a snapshot of the scheduler for the api
+type queueMetrics struct {
+	Threads int                    `json:"threads"`
+	Active  int                    `json:"active"`
+	Waiting int                    `json:"waiting"` // jobs waiting for a worker
+	Pending int                    `json:"pending"` // jobs waiting for their repo's running job
+	Hosts   map[string]hostMetrics `json:"hosts"`
+	Repos   []repoMetrics          `json:"repos"`
+}
+
+type hostMetrics struct {
+	Active  int `json:"active"`
+	Waiting int `json:"waiting"`
+	Limit   int `json:"limit"` // 0 for no limit
+}
+
+type repoMetrics struct {
+	Path     string `json:"path"`
+	Repo     string `json:"repo"`
+	Host     string `json:"host,omitempty"`
+	Priority int    `json:"priority"`
+	Running  string `json:"running,omitempty"` // job ids
+	Pending  string `json:"pending,omitempty"`
+	Waiting  bool   `json:"waiting"` // the running job is still waiting for a worker
+}
+
+// metrics returns the current state of the queue, repos with jobs by priority
+func (s *scheduler) metrics() queueMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := queueMetrics{
+		Threads: s.threads,
+		Active:  s.active,
+		Waiting: len(s.waiting),
+		Hosts:   make(map[string]hostMetrics),
+		Repos:   []repoMetrics{},
+	}
+	waiting := make(map[*job]bool)
+	for _, j := range s.waiting {
+		waiting[j] = true
+		h := m.Hosts[j.host]
+		h.Waiting++
+		m.Hosts[j.host] = h
+	}
+	for host, n := range s.hosts {
+		h := m.Hosts[host]
+		h.Active = n
+		m.Hosts[host] = h
+	}
+	for host, h := range m.Hosts {
+		h.Limit = hostLimit(host)
+		m.Hosts[host] = h
+	}
+
+	for path, q := range s.queues {
+		if q.running == nil {
+			continue
+		}
+		rm := repoMetrics{
+			Path:     path,
+			Repo:     q.running.repo.Name(),
+			Host:     q.running.host,
+			Priority: q.running.repo.Priority,
+			Running:  q.running.id,
+			Waiting:  waiting[q.running],
+		}
+		if q.pending != nil {
+			rm.Pending = q.pending.id
+			m.Pending++
+		}
+		m.Repos = append(m.Repos, rm)
+	}
+	sort.Slice(m.Repos, func(a, b int) bool {
+		if m.Repos[a].Priority != m.Repos[b].Priority {
+			return m.Repos[a].Priority > m.Repos[b].Priority
+		}
+		return m.Repos[a].Path < m.Repos[b].Path
+	})
+	return m
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testJob is a tracked job for the repo at path, job types other than clone,
+// update, checkout and rollback run without doing anything
+func testJob(path, jobType string) *job {
+	return newJob(&repo{URL: "https://" + path + ".git", Path: path}, jobType)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// setConf publishes a copy of the config changed by fn for the rest of the test
+func setConf(t *testing.T, fn func(c *config)) {
+	saved := conf()
+	c := *saved
+	fn(&c)
+	current.Store(&c)
+	t.Cleanup(func() { current.Store(saved) })
+}
+
+func isFinished(j *job) bool {
+	select {
+	case <-j.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSubmitFoldsPendingJobs(t *testing.T) {
+	// no workers, so the first job waits and the rest queue behind it
+	s := newScheduler(0)
+	const path = "example.com/a/b"
+
+	running := testJob(path, "noop")
+	s.submit(running)
+	pending := testJob(path, "update")
+	pending.delivery, pending.sha, pending.payload = "d1", "sha1", []byte("p1")
+	s.submit(pending)
+	checkout := testJob(path, "checkout")
+	checkout.delivery, checkout.sha, checkout.payload = "d2", "sha2", []byte("p2")
+	s.submit(checkout)
+	// without a delivery the pending job keeps its target
+	manual := testJob(path, "update")
+	s.submit(manual)
+
+	s.mu.Lock()
+	q := s.queues[path]
+	if q.running != running || q.pending != pending {
+		t.Errorf("got running %v pending %v, want %v and %v", q.running.id, q.pending.id, running.id, pending.id)
+	}
+	s.mu.Unlock()
+
+	if pending.jobType != "checkout" {
+		t.Errorf("folded job type is %v, want checkout", pending.jobType)
+	}
+	if pending.delivery != "d2" || pending.sha != "sha2" || string(pending.payload) != "p2" {
+		t.Errorf("folded job targets %v %v %q, want d2 sha2 \"p2\"", pending.delivery, pending.sha, pending.payload)
+	}
+	for _, j := range []*job{checkout, manual} {
+		if !isFinished(j) {
+			t.Errorf("folded job %v wasn't released", j.id)
+		}
+		if st, ok := lookupJob(j.id); !ok || st.ID != pending.id {
+			t.Errorf("folded job %v looks up as %v, want %v", j.id, st.ID, pending.id)
+		}
+	}
+	if st, _ := lookupJob(pending.id); len(st.Folded) != 2 {
+		t.Errorf("pending job records %v folded jobs, want 2", len(st.Folded))
+	}
+	waitFor(t, "the running job to wait for a worker", func() bool { return s.metrics().Waiting == 1 })
+	if m := s.metrics(); m.Pending != 1 || m.Active != 0 {
+		t.Errorf("got %v pending and %v active, want 1 and 0", m.Pending, m.Active)
+	}
+
+	// cancelled jobs still go through the queue, without touching git
+	pending.cancel()
+	s.resize(1)
+	s.wait()
+	if !isFinished(running) || !isFinished(pending) {
+		t.Error("wait returned before the repo's jobs finished")
+	}
+	s.mu.Lock()
+	if q.running != nil || q.pending != nil {
+		t.Error("queue not empty after wait")
+	}
+	s.mu.Unlock()
+}
+
+func TestFoldKeepsRollbacks(t *testing.T) {
+	for _, first := range []string{"update", "rollback"} {
+		s := newScheduler(0)
+		path := "example.com/" + first
+
+		s.submit(testJob(path, "noop"))
+		p := testJob(path, first)
+		s.submit(p)
+		second := "rollback"
+		if first == "rollback" {
+			second = "update"
+		}
+		j := testJob(path, second)
+		j.delivery, j.sha = "d1", "sha1"
+		s.submit(j)
+
+		keep, drop := j, p
+		if first == "rollback" {
+			keep, drop = p, j
+		}
+		s.mu.Lock()
+		if s.queues[path].pending != keep {
+			t.Errorf("%v then %v: %v job left pending, want the rollback", first, second, s.queues[path].pending.jobType)
+		}
+		s.mu.Unlock()
+		if !isFinished(drop) {
+			t.Errorf("%v then %v: update job wasn't released", first, second)
+		}
+		if st, _ := lookupJob(drop.id); st.State != "skipped" {
+			t.Errorf("%v then %v: dropped job is %v, want skipped", first, second, st.State)
+		}
+		if first == "rollback" && p.sha != "" {
+			t.Errorf("%v then %v: rollback picked up the update's sha", first, second)
+		}
+
+		s.cancelAll()
+		s.resize(1)
+		s.wait()
+	}
+}
+
+func TestResizeStartsWaitingJobs(t *testing.T) {
+	s := newScheduler(0)
+	var jobs []*job
+	for _, path := range []string{"example.com/a", "example.com/b", "example.com/c"} {
+		j := testJob(path, "noop")
+		jobs = append(jobs, j)
+		s.submit(j)
+	}
+	waitFor(t, "jobs to wait for a worker", func() bool { return s.metrics().Waiting == 3 })
+	if m := s.metrics(); m.Active != 0 || len(m.Repos) != 3 {
+		t.Errorf("got %v active and %v repos, want 0 and 3", m.Active, len(m.Repos))
+	}
+
+	s.resize(2)
+	s.wait()
+	for _, j := range jobs {
+		if !isFinished(j) {
+			t.Errorf("job %v didn't finish", j.id)
+		}
+	}
+	if m := s.metrics(); m.Active != 0 || m.Waiting != 0 || len(m.Repos) != 0 {
+		t.Errorf("got %v active, %v waiting and %v repos after wait, want none", m.Active, m.Waiting, len(m.Repos))
+	}
+}
+
+func TestNextByPriorityAndHost(t *testing.T) {
+	setConf(t, func(c *config) {
+		c.HostThreads = 1
+		c.HostLimits = map[string]int{"big.example.com": 3}
+	})
+
+	waiting := func(host string, priority int) *job {
+		return &job{host: host, repo: &repo{Priority: priority}}
+	}
+	low := waiting("a.example.com", 0)
+	high := waiting("b.example.com", 5)
+	high2 := waiting("b.example.com", 5)
+	big := waiting("big.example.com", 1)
+
+	s := newScheduler(2)
+	s.waiting = []*job{low, high, high2}
+	if got := s.next(); got != high {
+		t.Error("next didn't pick the oldest highest priority job")
+	}
+
+	// b.example.com is at host_threads
+	s.active, s.hosts["b.example.com"] = 1, 1
+	if got := s.next(); got != low {
+		t.Error("next didn't skip jobs for a host at its limit")
+	}
+
+	// host_limits overrides host_threads
+	s.waiting = []*job{low, big}
+	s.hosts["big.example.com"] = 2
+	if got := s.next(); got != big {
+		t.Error("next didn't apply the host's own limit")
+	}
+
+	s.active = 2
+	if got := s.next(); got != nil {
+		t.Error("next picked a job with every worker busy")
+	}
+}
+
+func TestCancelDropsPendingJob(t *testing.T) {
+	s := newScheduler(0)
+	const path = "example.com/cancel"
+
+	running := testJob(path, "noop")
+	s.submit(running)
+	pending := testJob(path, "update")
+	s.submit(pending)
+
+	if n := s.cancel(path); n != 2 {
+		t.Errorf("cancel affected %v jobs, want 2", n)
+	}
+	if !isFinished(pending) {
+		t.Error("pending job wasn't released")
+	}
+	if n := s.cancel("example.com/unknown"); n != 0 {
+		t.Errorf("cancel of an unknown repo affected %v jobs", n)
+	}
+
+	s.resize(1)
+	s.wait()
+	st, _ := lookupJob(running.id)
+	if st.State != "cancelled" || st.Started != nil {
+		t.Errorf("cancelled job is %v, started %v, want cancelled before it started", st.State, st.Started)
+	}
+}
+
+func TestSlotRespectsHostLimit(t *testing.T) {
+	setConf(t, func(c *config) { c.HostThreads = 1 })
+	s := newScheduler(5)
+	r := &repo{URL: "https://example.com/a.git", Path: "example.com/a"}
+
+	release := make(chan struct{})
+	first, second := make(chan struct{}), make(chan struct{})
+	go s.slot(r, "example.com", func() {
+		close(first)
+		<-release
+	})
+	<-first
+	go s.slot(r, "example.com", func() { close(second) })
+
+	waitFor(t, "the second slot to wait", func() bool { return s.metrics().Waiting == 1 })
+	select {
+	case <-second:
+		t.Fatal("second slot ran while the host was at its limit")
+	default:
+	}
+	if m := s.metrics(); m.Active != 1 || m.Hosts["example.com"].Active != 1 {
+		t.Errorf("got %v active, %v on the host, want 1 and 1", m.Active, m.Hosts["example.com"].Active)
+	}
+
+	close(release)
+	<-second
+	waitFor(t, "the slots to be freed", func() bool { return s.metrics().Active == 0 })
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// reconcilers stops the running reconcile loops when the config is replaced
+var reconcilers struct {
+	sync.Mutex
+	stop context.CancelFunc
+}
+
+// startReconcilers starts a reconcile loop for every repo with a
+// reconcileInterval or reconcileCron, replacing any already running
+func (c *config) startReconcilers() {
+	reconcilers.Lock()
+	defer reconcilers.Unlock()
+	if reconcilers.stop != nil {
+		reconcilers.stop()
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	reconcilers.stop = stop
+
+	for i := range c.Repos {
+		r := &c.Repos[i]
+		next, err := r.reconcileSchedule()
+		if err != nil {
+			log.WithField("repo", r.Name()).Errorf("Invalid reconcile schedule, not reconciling: %v", err)
+			continue
+		}
+		if next != nil {
+			go r.reconcileLoop(ctx, next)
+		}
+	}
+}
+
+// reconcileSchedule returns a function giving the next reconcile time after
+// t, nil when the repo isn't reconciled periodically
+func (r *repo) reconcileSchedule() (func(t time.Time) time.Time, error) {
+	switch {
+	case r.ReconcileCron != "":
+		cron, err := parseCron(r.ReconcileCron)
+		if err != nil {
+			return nil, err
+		}
+		if cron.next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("cron expression %q never matches", r.ReconcileCron)
+		}
+		return cron.next, nil
+	case r.ReconcileInterval != "":
+		d, err := time.ParseDuration(r.ReconcileInterval)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("reconcileInterval %v is below the 1m minimum", d)
+		}
+		return func(t time.Time) time.Time { return t.Add(d) }, nil
+	}
+	return nil, nil
+}
+
+func (r *repo) reconcileLoop(ctx context.Context, next func(t time.Time) time.Time) {
+	for {
+		if !sleep(ctx, time.Until(next(time.Now()))) {
+			return
+		}
+		r.reconcile(ctx)
+	}
+}
+
+// reconcileAll is the startup catch up, for deliveries missed while gwg was down
+func (c *config) reconcileAll() {
+	for i := range c.Repos {
+		c.Repos[i].reconcile(context.Background())
+	}
+}
+
+// reconcile queues an update when the remote label has moved on from the
+// local copy, a safety net for missed webhooks. The remote is only listed,
+// nothing is fetched when the repo is current.
+func (r *repo) reconcile(ctx context.Context) {
+	rlog := log.WithFields(logrus.Fields{
+		"repo":      r.Name(),
+		"path":      r.Path,
+		"label":     r.Label,
+		"labelType": r.LabelType,
+	})
+
+	// commit / revision labels never move, pinned repos are held anyway
+	if r.IsFrozen() {
+		return
+	}
+	if _, ok := r.pinned(); ok {
+		return
+	}
+	// missing repos are cloned by initialClone
+	if _, err := os.Stat(r.Directory); err != nil {
+		return
+	}
+
+	local, err := r.localLabel()
+	if err != nil {
+		rlog.Errorf("Failed to reconcile, couldn't read local label: %v", err)
+		return
+	}
+	remote, served, err := r.lsRemote(ctx)
+	if err != nil {
+		rlog.Errorf("Failed to reconcile: %v", err)
+		return
+	}
+	if remote == local {
+		rlog.Debugf("Reconciled, up to date at %v", shortSHA(local.String()))
+		return
+	}
+
+	if r.rolledBackFrom(remote.String()) {
+		rlog.Debugf("Reconciled, %v was rolled back, waiting for a new push", shortSHA(remote.String()))
+		return
+	}
+
+	rlog.WithField("remote", served).Warnf("Reconcile found %v at %v, local copy is at %v, queuing an update",
+		r.labelRef(), shortSHA(remote.String()), shortSHA(local.String()))
+	j := newJob(r, "update")
+	j.sha = remote.String()
+	conf().DataPasser.jobs <- j
+}
+
+// localLabel is what the remote label pointed at when it was last deployed,
+// HEAD for branches and the fetched tag (which may be an annotated tag object)
+func (r *repo) localLabel() (plumbing.Hash, error) {
+	repo, err := git.PlainOpen(r.Directory)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	name := plumbing.HEAD
+	if r.LabelType == "tag" {
+		name = plumbing.ReferenceName(r.labelRef())
+	}
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
+
+// lsRemote lists the upstream refs, trying each remote in turn, and returns
+// the label's hash and the remote that answered
+func (r *repo) lsRemote(ctx context.Context) (plumbing.Hash, string, error) {
+	var err error
+	for i := range r.Remotes {
+		rm := &r.Remotes[i]
+		var refs []*plumbing.Reference
+		// takes a worker like any job, so repos sharing a schedule don't all
+		// connect to the same host at once
+		sched.slot(r, rm.host(), func() {
+			lctx, cancel := context.WithTimeout(ctx, r.fetchTimeout())
+			defer cancel()
+			// nothing is written, no need to lock the directory
+			err = run(lctx, "", func() (err error) {
+				refs, err = rm.list()
+				return err
+			})
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to list remote %v: %v", rm.Name, err)
+			continue
+		}
+		for _, ref := range refs {
+			if ref.Name().String() == r.labelRef() {
+				return ref.Hash(), rm.Name, nil
+			}
+		}
+		return plumbing.ZeroHash, rm.Name, fmt.Errorf("remote %v has no %v", rm.Name, r.labelRef())
+	}
+	return plumbing.ZeroHash, "", err
+}
+
+// list is git ls-remote, always against the upstream as a mirror is only as
+// current as its last refresh
+func (rm *remote) list() ([]*plumbing.Reference, error) {
+	auth, err := rm.auth()
+	if err != nil {
+		return nil, err
+	}
+	// go-git only lists through a repository's remote, an empty one in memory will do
+	mem, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := mem.CreateRemote(&gitconfig.RemoteConfig{Name: rm.Name, URLs: []string{rm.URL}})
+	if err != nil {
+		return nil, err
+	}
+	return remote.List(&git.ListOptions{Auth: auth})
+}
+
+// cronSchedule is a parsed 5 field cron expression, minute hour day-of-month
+// month day-of-week
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+// parseCron parses a standard 5 field cron expression, supporting *, lists,
+// ranges and steps
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]map[int]bool
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+		}
+		sets[i] = set
+	}
+	// sunday is 0 or 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(f string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bits := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bits[0])
+			hi, err2 = strconv.Atoi(bits[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %v-%v", part, min, max)
+		}
+		for n := lo; n <= hi; n += step {
+			set[n] = true
+		}
+	}
+	return set, nil
+}
+
+// next is the first time after t matching the schedule
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// every schedule matches at least once in 4 years (29th of february)
+	for limit := t.AddDate(4, 0, 1); t.Before(limit); {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.day(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	// impossible dates like the 31st of february never match
+	return time.Time{}
+}
+
+// day matches the day of month and week like cron, when both are restricted
+// either one matching will do
+func (c *cronSchedule) day(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) didn't fail", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// the 1st of january 2026 is a thursday
+	for _, c := range []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2026-01-01 10:07:30", "2026-01-01 10:08:00"},
+		{"*/15 * * * *", "2026-01-01 10:07:30", "2026-01-01 10:15:00"},
+		{"5/20 * * * *", "2026-01-01 10:26:00", "2026-01-01 10:45:00"},
+		{"0 0 * * *", "2026-01-01 10:07:00", "2026-01-02 00:00:00"},
+		// strictly after, never the time itself
+		{"5 4 * * *", "2026-01-01 04:05:00", "2026-01-02 04:05:00"},
+		{"30 2 1 * *", "2026-01-31 12:00:00", "2026-02-01 02:30:00"},
+		{"0 12 1,15 6-8 *", "2026-06-15 12:00:00", "2026-07-01 12:00:00"},
+		{"0 0 1 1 *", "2026-12-31 23:59:00", "2027-01-01 00:00:00"},
+		{"0 9 * * 1-5", "2026-01-03 08:00:00", "2026-01-05 09:00:00"},
+		// sunday is 0 or 7
+		{"0 0 * * 0", "2026-01-01 00:00:00", "2026-01-04 00:00:00"},
+		{"0 0 * * 7", "2026-01-01 00:00:00", "2026-01-04 00:00:00"},
+		// with both days restricted either matches
+		{"0 0 13 * 5", "2026-01-01 00:00:00", "2026-01-02 00:00:00"},
+		{"0 0 13 * 5", "2026-01-12 00:00:00", "2026-01-13 00:00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00:00", "2028-02-29 00:00:00"},
+	} {
+		s, err := parseCron(c.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", c.expr, err)
+			continue
+		}
+		if got := s.next(at(c.from)); !got.Equal(at(c.want)) {
+			t.Errorf("%q after %v: got %v, want %v", c.expr, c.from, got.Format("2006-01-02 15:04:05"), c.want)
+		}
+	}
+}
+
+func TestCronNextNeverMatches(t *testing.T) {
+	s, err := parseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.next(time.Now()); !got.IsZero() {
+		t.Errorf("the 31st of february matched %v", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// verify checks the local repository is readable, HEAD resolves to a commit
+// we have and every reference points at an object we have.
+func verify(repo *git.Repository) error {
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %v", err)
+	}
+	if _, err := repo.CommitObject(head.Hash()); err != nil {
+		return fmt.Errorf("failed to read HEAD commit %v: %v", head.Hash(), err)
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		return fmt.Errorf("failed to read references: %v", err)
+	}
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		// blank ref files after a flaky fetch
+		if ref.Hash().IsZero() {
+			return fmt.Errorf("blank reference %v", ref.Name())
+		}
+		if _, err := repo.Object(plumbing.AnyObject, ref.Hash()); err != nil {
+			return fmt.Errorf("broken reference %v: %v", ref.Name(), err)
+		}
+		return nil
+	})
+}
+
+// unreadable reports whether err means the local repository is missing or
+// can't be read rather than broken, a fresh clone won't fix either
+func unreadable(err error) bool {
+	return err == git.ErrRepositoryNotExists || os.IsNotExist(err) || os.IsPermission(err)
+}
+
+// exchangeByRename swaps the paths a and b with three renames, for when they
+// can't be exchanged atomically. b is briefly missing.
+func exchangeByRename(a, b string) error {
+	aside := b + ".gwg-swap"
+	if err := os.Rename(b, aside); err != nil {
+		return err
+	}
+	if err := os.Rename(a, b); err != nil {
+		os.Rename(aside, b)
+		return err
+	}
+	return os.Rename(aside, a)
+}
+
+// reclone replaces an unrecoverable local repository with a fresh clone.
+// The clone goes into a temporary sibling directory first and is only swapped
+// in once complete, atomically where the platform allows, the broken copy is
+// kept next to it for inspection.
+func (r *repo) reclone(ctx context.Context, cause error) (plumbing.Hash, error) {
+	rlog := log.WithFields(logrus.Fields{
+		"repo":      r.Name(),
+		"path":      r.Path,
+		"label":     r.Label,
+		"labelType": r.LabelType,
+	})
+
+	dir := filepath.Clean(r.Directory)
+	stamp := time.Now().Format("20060102-150405")
+	tmp := dir + ".gwg-recover-" + stamp
+	broken := dir + ".gwg-broken-" + stamp
+
+	rlog.Warnf("Local repository looks unrecoverable, cloning a fresh copy into %v", tmp)
+	if _, err := r.cloneInto(ctx, tmp); err != nil {
+		rlog.Errorf("Failed to clone fresh copy, leaving repository as is: %v", err)
+		os.RemoveAll(tmp)
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		if err := exchange(tmp, dir); err != nil {
+			rlog.Errorf("Failed to swap in fresh copy: %v", err)
+			os.RemoveAll(tmp)
+			return plumbing.ZeroHash, err
+		}
+		// the broken copy is now at tmp
+		if err := os.Rename(tmp, broken); err != nil {
+			rlog.Warnf("Failed to rename broken repository, leaving it at %v: %v", tmp, err)
+			broken = tmp
+		}
+	} else {
+		broken = ""
+		if err := os.Rename(tmp, dir); err != nil {
+			rlog.Errorf("Failed to move fresh copy into place: %v", err)
+			os.RemoveAll(tmp)
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	rlog.WithFields(logrus.Fields{
+		"event":  "recovered",
+		"cause":  cause.Error(),
+		"broken": broken,
+	}).Warn("Replaced corrupted repository with a fresh clone")
+
+	head, err := r.deployHead()
+	if err != nil {
+		rlog.Error(err)
+		return plumbing.ZeroHash, err
+	}
+	return head, nil
+}
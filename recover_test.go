@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+func TestExchange(t *testing.T) {
+	for name, swap := range map[string]func(a, b string) error{
+		"exchange":         exchange,
+		"exchangeByRename": exchangeByRename,
+	} {
+		dir := t.TempDir()
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		for _, d := range []string{a, b} {
+			if err := os.Mkdir(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(d, "name"), []byte(filepath.Base(d)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := swap(a, b); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		for d, want := range map[string]string{a: "b", b: "a"} {
+			got, err := ioutil.ReadFile(filepath.Join(d, "name"))
+			if err != nil || string(got) != want {
+				t.Errorf("%v: %v holds %q (%v), want %q", name, d, got, err, want)
+			}
+		}
+		if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+			t.Errorf("%v: left %v entries behind, want 2", name, len(entries))
+		}
+	}
+}
+
+func TestUnreadable(t *testing.T) {
+	_, err := git.PlainOpen(filepath.Join(t.TempDir(), "missing"))
+	if err == nil || !unreadable(err) {
+		t.Errorf("missing directory: got %v, want it unreadable", err)
+	}
+
+	// a .git that isn't a repository is broken, not unreadable
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, ".git"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.PlainOpen(dir); err == nil || unreadable(err) {
+		t.Errorf("broken .git: got %v, want an error that isn't unreadable", err)
+	}
+}
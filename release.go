@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func (r *repo) IsRelease() bool {
+	return r.DeployMode == "release"
+}
+
+// validateReleases drops release mode repos sharing a releaseDir or
+// currentLink with an earlier one, they'd switch and prune each other's
+// releases
+func (c *config) validateReleases() {
+	owners := make(map[string]string)
+	valid := c.Repos[:0]
+	for _, r := range c.Repos {
+		if r.IsRelease() {
+			dir, link := filepath.Clean(r.ReleaseDir), filepath.Clean(r.CurrentLink)
+			if owner, ok := owners[dir]; ok {
+				log.Errorf("Repo %v has the same releaseDir %v as repo %v, ignoring it", r.Name(), dir, owner)
+				continue
+			}
+			if owner, ok := owners[link]; ok {
+				log.Errorf("Repo %v has the same currentLink %v as repo %v, ignoring it", r.Name(), link, owner)
+				continue
+			}
+			owners[dir], owners[link] = r.Name(), r.Name()
+		}
+		valid = append(valid, r)
+	}
+	c.Repos = valid
+}
+
+// deploy publishes hash, in release mode it's exported into a new release
+// directory and the current symlink switched over, in place mode the work
+// tree is already up to date so there's nothing to do.
+func (r *repo) deploy(repo *git.Repository, hash plumbing.Hash) error {
+	if !r.IsRelease() {
+		return nil
+	}
+	rlog := log.WithFields(logrus.Fields{
+		"repo":      r.Name(),
+		"path":      r.Path,
+		"label":     r.Label,
+		"labelType": r.LabelType,
+	})
+
+	if err := os.MkdirAll(r.ReleaseDir, 0755); err != nil {
+		return fmt.Errorf("failed to create releases directory: %v", err)
+	}
+
+	name := time.Now().UTC().Format("20060102150405") + "-" + hash.String()[:7]
+	release := filepath.Join(r.ReleaseDir, name)
+	// export into a hidden directory first so a half written release is never visible
+	tmp := filepath.Join(r.ReleaseDir, "."+name)
+	if err := exportTree(repo, hash, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to export release: %v", err)
+	}
+	if err := os.Rename(tmp, release); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to create release: %v", err)
+	}
+	// the link must not depend on our working directory
+	if abs, err := filepath.Abs(release); err == nil {
+		release = abs
+	}
+
+	if err := switchSymlink(release, r.CurrentLink); err != nil {
+		return fmt.Errorf("failed to switch %v to new release: %v", r.CurrentLink, err)
+	}
+	rlog.Infof("Switched %v to release %v", r.CurrentLink, name)
+
+	r.pruneReleases()
+	return nil
+}
+
+// exportTree writes the tree of commit hash into dir, without any git metadata
+func exportTree(repo *git.Repository, hash plumbing.Hash, dir string) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return tree.Files().ForEach(func(f *object.File) error {
+		path := filepath.Join(dir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if f.Mode == filemode.Symlink {
+			target, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, path)
+		}
+
+		mode := os.FileMode(0644)
+		if f.Mode == filemode.Executable {
+			mode = 0755
+		}
+		src, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	})
+}
+
+// switchSymlink atomically points link at target, a new link is created
+// alongside and renamed over the old one.
+func switchSymlink(target, link string) error {
+	tmp := link + ".gwg-tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// releases returns the release directories, oldest first
+func (r *repo) releases() ([]string, error) {
+	entries, err := ioutil.ReadDir(r.ReleaseDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	// names start with a timestamp
+	sort.Strings(names)
+	return names, nil
+}
+
+// pruneReleases removes all but the last KeepReleases releases, the release
+// current points at is always kept.
+func (r *repo) pruneReleases() {
+	rlog := log.WithFields(logrus.Fields{
+		"repo": r.Name(),
+		"path": r.Path,
+	})
+
+	names, err := r.releases()
+	if err != nil {
+		rlog.Errorf("Failed to list releases: %v", err)
+		return
+	}
+	if len(names) <= r.KeepReleases {
+		return
+	}
+
+	current, _ := os.Readlink(r.CurrentLink)
+	for _, name := range names[:len(names)-r.KeepReleases] {
+		release, _ := filepath.Abs(filepath.Join(r.ReleaseDir, name))
+		if release == current {
+			continue
+		}
+		if err := os.RemoveAll(release); err != nil {
+			rlog.Errorf("Failed to remove old release %v: %v", name, err)
+			continue
+		}
+		rlog.Infof("Removed old release %v", name)
+	}
+}
+
+// deployHead deploys whatever HEAD of the local clone points at
+func (r *repo) deployHead() (plumbing.Hash, error) {
+	repo, err := git.PlainOpen(r.Directory)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to open local git repository: %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get local HEAD reference: %v", err)
+	}
+	return head.Hash(), r.deploy(repo, head.Hash())
+}
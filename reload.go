@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reload signals a running service after a successful update
+type reload struct {
+	PIDFile string `mapstructure:"pidfile"` // read the pid from here
+	Process string `mapstructure:"process"` // or signal processes with this name, leaving out children of other matches
+	Signal  string `mapstructure:"signal"`  // HUP, INT, QUIT, TERM, USR1 or USR2, defaults to HUP
+}
+
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// validateReloads drops reload actions that can't work
+func (c *config) validateReloads() {
+	for i := range c.Repos {
+		rl := c.Repos[i].Reload
+		if rl == nil {
+			continue
+		}
+		if isEmpty(rl.PIDFile) && isEmpty(rl.Process) {
+			log.Errorf("Reload for repo %v needs a pidfile or process, ignoring it", c.Repos[i].Name())
+			c.Repos[i].Reload = nil
+			continue
+		}
+		rl.Signal = strings.TrimPrefix(strings.ToUpper(rl.Signal), "SIG")
+		if rl.Signal == "" {
+			rl.Signal = "HUP"
+		}
+		if _, ok := reloadSignals[rl.Signal]; !ok {
+			log.Errorf("Unknown reload signal %v for repo %v, ignoring the reload", rl.Signal, c.Repos[i].Name())
+			c.Repos[i].Reload = nil
+		}
+	}
+}
+
+// reload sends the configured signal to the repo's service, recording the
+// outcome with the deployment's commands. A failure only fails updates and
+// rollbacks, clones just warn.
+func (r *repo) reload(d *deployment) error {
+	rl := r.Reload
+	if rl == nil {
+		return nil
+	}
+	rlog := log.WithFields(logrus.Fields{
+		"repo":   r.Name(),
+		"path":   r.Path,
+		"signal": rl.Signal,
+	})
+	res := commandResult{Stage: "reload", Run: "kill -" + rl.Signal, ExitCode: -1}
+	start := time.Now()
+	defer func() {
+		res.Seconds = time.Since(start).Seconds()
+		d.Commands = append(d.Commands, res)
+	}()
+
+	pids, err := rl.pids()
+	if err == nil {
+		res.Run += " " + strings.Trim(fmt.Sprint(pids), "[]")
+		for _, pid := range pids {
+			if err = syscall.Kill(pid, reloadSignals[rl.Signal]); err != nil {
+				err = fmt.Errorf("failed to send SIG%v to %v: %v", rl.Signal, pid, err)
+				break
+			}
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+		// the service usually isn't running yet when gwg makes the first clone
+		if d.Type == "clone" {
+			rlog.Warnf("Failed to reload after clone, ignoring: %v", err)
+			return nil
+		}
+		rlog.Errorf("Failed to reload: %v", err)
+		return err
+	}
+	res.ExitCode = 0
+	rlog.Infof("Sent SIG%v to %v", rl.Signal, strings.Trim(fmt.Sprint(pids), "[]"))
+	return nil
+}
+
+// pids finds the processes to signal, from the pidfile or by name
+func (rl *reload) pids() ([]int, error) {
+	if !isEmpty(rl.PIDFile) {
+		b, err := ioutil.ReadFile(rl.PIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pidfile: %v", err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("invalid pid in %v: %q", rl.PIDFile, strings.TrimSpace(string(b)))
+		}
+		return []int{pid}, nil
+	}
+	return findProcesses(rl.Process)
+}
+
+// findProcesses returns the pids of processes called name, leaving out any
+// whose parent is called name too so only the master of a pool is signalled
+func findProcesses(name string) ([]int, error) {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]int)
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		// processes come and go while we look, skip any that went
+		if ppid, ok := processParent(dir, name); ok {
+			parents[pid] = ppid
+		}
+	}
+	var pids []int
+	for pid, ppid := range parents {
+		if _, ok := parents[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process called %v found", name)
+	}
+	return pids, nil
+}
+
+// processParent returns the parent pid of the process in the /proc dir if it's
+// called name, matching either its command name or the base of its executable
+func processParent(dir, name string) (int, bool) {
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return 0, false
+	}
+	// pid (comm) state ppid ..., comm can contain spaces and brackets
+	s := string(stat)
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return 0, false
+	}
+	comm := s[open+1 : end]
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	if comm == name {
+		return ppid, true
+	}
+	// comm is cut to 15 characters, fall back to argv[0]
+	cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil || len(cmdline) == 0 {
+		return 0, false
+	}
+	argv0 := strings.Fields(strings.SplitN(string(cmdline), "\x00", 2)[0])
+	if len(argv0) > 0 && filepath.Base(argv0[0]) == name {
+		return ppid, true
+	}
+	return 0, false
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	cryptossh "golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// remote is one of a repo's upstreams, tried in order until one works
+type remote struct {
+	Name          string `mapstructure:"name"`
+	URL           string `mapstructure:"url"`
+	SSHPrivKey    string `mapstructure:"sshPrivKey"`
+	SSHPassPhrase string `mapstructure:"sshPassPhrase"`
+}
+
+// auth returns the ssh auth method for the remote, nil for public repositories
+func (rm *remote) auth() (transport.AuthMethod, error) {
+	if isEmpty(rm.SSHPrivKey) {
+		return nil, nil
+	}
+	sshAuth, err := ssh.NewPublicKeysFromFile("git", rm.SSHPrivKey, rm.SSHPassPhrase)
+	if err != nil {
+		// a missing or unreadable key won't fix itself between attempts
+		return nil, permanentError{fmt.Errorf("failed to setup ssh auth for remote %v: %v", rm.Name, err)}
+	}
+	return dialTimeout{sshAuth}, nil
+}
+
+// sshDialTimeout limits how long connecting to an ssh remote may take
+const sshDialTimeout = 30 * time.Second
+
+// dialTimeout puts a connect timeout on ssh connections, go-git has no other
+// way to set one and a dial never gives up by itself
+type dialTimeout struct {
+	*ssh.PublicKeys
+}
+
+func (a dialTimeout) ClientConfig() (*cryptossh.ClientConfig, error) {
+	cfg, err := a.PublicKeys.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Timeout = sshDialTimeout
+	return cfg, nil
+}
+
+// host is the remote's host name, blank for local paths
+func (rm *remote) host() string {
+	u := rm.URL
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+		if i := strings.IndexAny(u, "/"); i >= 0 {
+			u = u[:i]
+		}
+		if i := strings.LastIndex(u, "@"); i >= 0 {
+			u = u[i+1:]
+		}
+		if h, _, err := net.SplitHostPort(u); err == nil {
+			u = h
+		}
+		return strings.ToLower(u)
+	}
+	// scp style, user@host:path
+	i := strings.Index(u, ":")
+	if i < 0 || strings.ContainsAny(u[:i], "/") {
+		return ""
+	}
+	u = u[:i]
+	if i := strings.LastIndex(u, "@"); i >= 0 {
+		u = u[i+1:]
+	}
+	return strings.ToLower(u)
+}
+
+// setRemoteDefaults turns the single url / remote / ssh key fields into the
+// first remote when no remotes are listed, or fills them from the first remote.
+func (r *repo) setRemoteDefaults() {
+	if len(r.Remotes) == 0 {
+		r.Remotes = []remote{{
+			Name:          r.Remote,
+			URL:           r.URL,
+			SSHPrivKey:    r.SSHPrivKey,
+			SSHPassPhrase: r.SSHPassPhrase,
+		}}
+		return
+	}
+	for i := range r.Remotes {
+		if r.Remotes[i].Name != "" {
+			continue
+		}
+		if i == 0 {
+			r.Remotes[i].Name = r.Remote
+		} else {
+			r.Remotes[i].Name = fmt.Sprintf("remote%d", i)
+		}
+	}
+	// the first remote is the primary, github pushes to it
+	r.Remote = r.Remotes[0].Name
+	if r.URL == "" {
+		r.URL = r.Remotes[0].URL
+	}
+}
+
+// ensureRemotes adds any remotes missing from the local repository and
+// updates urls changed in the config
+func (r *repo) ensureRemotes(repo *git.Repository) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to read repository config: %v", err)
+	}
+
+	changed := false
+	for _, rm := range r.Remotes {
+		url := rm.fetchURL()
+		rc, ok := cfg.Remotes[rm.Name]
+		if !ok {
+			cfg.Remotes[rm.Name] = &gitconfig.RemoteConfig{
+				Name:  rm.Name,
+				URLs:  []string{url},
+				Fetch: []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf(gitconfig.DefaultFetchRefSpec, rm.Name))},
+			}
+			changed = true
+			continue
+		}
+		if len(rc.URLs) != 1 || rc.URLs[0] != url {
+			rc.URLs = []string{url}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := repo.Storer.SetConfig(cfg); err != nil {
+		return fmt.Errorf("failed to update repository remotes: %v", err)
+	}
+	return nil
+}
+
+// fetch fetches from the first remote that works, falling over to the next
+// once the retry policy gives up, and returns the remote that served the fetch.
+// git.NoErrAlreadyUpToDate is returned as is. Each attempt is limited to the
+// fetch timeout, cancelling ctx stops any further attempts.
+func (r *repo) fetch(ctx context.Context, repo *git.Repository) (*remote, error) {
+	var err error
+	since := time.Now()
+	policy := r.retryPolicy()
+	for i := range r.Remotes {
+		rm := &r.Remotes[i]
+		rlog := log.WithFields(logrus.Fields{
+			"repo":   r.Name(),
+			"path":   r.Path,
+			"remote": rm.Name,
+		})
+
+		// fetches from github can be flaky, sometimes we get a blank .git/refs/remotes/[master|branch name],
+		// and complaints about broken refs, subsequent fetches should fix this!
+		// we'll fetch until it succeeds or the retry policy gives up.
+		upToDate := false
+		err = policy.do(ctx, rlog, "fetch", func() error {
+			actx, cancel := context.WithTimeout(ctx, r.fetchTimeout())
+			defer cancel()
+			err := run(actx, r.Directory, func() error {
+				return rm.fetchInto(actx, repo, since, true)
+			})
+			if err == git.NoErrAlreadyUpToDate {
+				upToDate = true
+				return nil
+			}
+			if err != nil && ctx.Err() == nil && actx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("fetch timed out after %v", r.fetchTimeout())
+			}
+			return err
+		})
+		if err == nil {
+			if upToDate {
+				return rm, git.NoErrAlreadyUpToDate
+			}
+			return rm, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if i < len(r.Remotes)-1 {
+			rlog.Warnf("Out of fetch retries, failing over to remote %v", r.Remotes[i+1].Name)
+		}
+	}
+	return nil, err
+}
+
+// fetchInto fetches the remote into repo, via the remote's mirror when enabled.
+// Callers run it with the repository's directory locked.
+func (rm *remote) fetchInto(ctx context.Context, repo *git.Repository, since time.Time, force bool) error {
+	if useMirrors() {
+		if err := refreshMirror(ctx, rm, since); err != nil {
+			return err
+		}
+		// local, no auth needed
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: rm.Name,
+			Force:      force,
+			Tags:       git.AllTags,
+		})
+	}
+
+	auth, err := rm.auth()
+	if err != nil {
+		return err
+	}
+	return repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: rm.Name,
+		Auth:       auth,
+		Force:      force,
+		Tags:       git.AllTags,
+	})
+}
+
+// cloneInto clones the configured label into dir from the first remote that
+// works, retrying each as per the retry policy, and returns the remote that
+// served the clone. Each attempt is limited to the clone timeout.
+func (r *repo) cloneInto(ctx context.Context, dir string) (*remote, error) {
+	// a failed attempt removes everything in dir, never clone over a checkout
+	existed, err := checkCloneDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	policy := r.retryPolicy()
+	for i := range r.Remotes {
+		rm := &r.Remotes[i]
+		rlog := log.WithFields(logrus.Fields{
+			"repo":   r.Name(),
+			"path":   r.Path,
+			"remote": rm.Name,
+		})
+		err = policy.do(ctx, rlog, "clone", func() error {
+			cctx, cancel := context.WithTimeout(ctx, r.cloneTimeout())
+			defer cancel()
+			err := run(cctx, dir, func() error {
+				err := r.cloneFrom(cctx, rm, dir)
+				if err != nil {
+					// don't leave a partial clone behind for the next attempt to trip over
+					clearCloneDir(dir, existed)
+				}
+				return err
+			})
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() == nil && cctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("clone timed out after %v", r.cloneTimeout())
+			}
+			return err
+		})
+		if err == nil {
+			return rm, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if i < len(r.Remotes)-1 {
+			rlog.Warnf("Out of clone retries, failing over to remote %v", r.Remotes[i+1].Name)
+		}
+	}
+	return nil, err
+}
+
+// checkCloneDir makes sure dir is missing or empty, and reports whether it exists
+func checkCloneDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		if err != nil {
+			return true, err
+		}
+		return true, permanentError{fmt.Errorf("%v already exists and isn't empty, not cloning over it", dir)}
+	}
+	return true, nil
+}
+
+// clearCloneDir removes what a failed clone attempt left in dir, and dir
+// itself unless it existed (empty) beforehand
+func clearCloneDir(dir string, existed bool) {
+	if !existed {
+		os.RemoveAll(dir)
+		return
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, _ := f.Readdirnames(-1)
+	f.Close()
+	for _, name := range names {
+		os.RemoveAll(filepath.Join(dir, name))
+	}
+}
+
+// cloneFrom clones from a single remote. go-git's clone only works with a
+// remote called origin, so init, add the remotes and fetch instead.
+func (r *repo) cloneFrom(ctx context.Context, rm *remote, dir string) error {
+	log.WithFields(logrus.Fields{"repo": r.Name(), "remote": rm.Name}).Debugf("Clone reference: %v", r.labelRef())
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		return err
+	}
+	if err := r.ensureRemotes(repo); err != nil {
+		return err
+	}
+	err = rm.fetchInto(ctx, repo, time.Now(), false)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	target, err := r.target(repo, rm.Name)
+	if err != nil {
+		return err
+	}
+
+	// checkout specific branch, everything else gets a detached HEAD
+	head := plumbing.NewHashReference(plumbing.HEAD, target)
+	if r.LabelType == "branch" {
+		branch := plumbing.ReferenceName(r.labelRef())
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, target)); err != nil {
+			return err
+		}
+		if err := repo.CreateBranch(&gitconfig.Branch{Name: r.Label, Remote: rm.Name, Merge: branch}); err != nil {
+			return err
+		}
+		head = plumbing.NewSymbolicReference(plumbing.HEAD, branch)
+	}
+	if err := repo.Storer.SetReference(head); err != nil {
+		return err
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: target})
+}
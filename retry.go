@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// retryPolicy controls how clones, fetches and resets are retried. Blank
+// fields in a repo's policy are taken from the global one.
+type retryPolicy struct {
+	Attempts   int     `mapstructure:"attempts"`   // max attempts, including the first
+	Delay      float64 `mapstructure:"delay"`      // seconds before the first retry
+	Multiplier float64 `mapstructure:"multiplier"` // the delay grows by this much after each retry
+	MaxDelay   float64 `mapstructure:"maxDelay"`   // seconds, caps the delay
+	Jitter     float64 `mapstructure:"jitter"`     // randomise the delay by up to this fraction either way
+}
+
+// setRetryDefaults fills the global policy, falling back to the older
+// retry_count / retry_delay settings
+func (c *config) setRetryDefaults() {
+	p := &c.Retry
+	if p.Attempts < 1 {
+		p.Attempts = c.RetryCount
+	}
+	if p.Attempts < 1 {
+		p.Attempts = 1
+	}
+	if p.Delay <= 0 {
+		p.Delay = float64(c.RetryDelay)
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 300
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		log.Errorf("Invalid retry jitter %v, must be between 0 and 1, using 0", p.Jitter)
+		p.Jitter = 0
+	}
+}
+
+// retryPolicy is the repo's policy merged over the global one
+func (r *repo) retryPolicy() retryPolicy {
+	p := conf().Retry
+	if r.Retry.Attempts > 0 {
+		p.Attempts = r.Retry.Attempts
+	}
+	if r.Retry.Delay > 0 {
+		p.Delay = r.Retry.Delay
+	}
+	if r.Retry.Multiplier >= 1 {
+		p.Multiplier = r.Retry.Multiplier
+	}
+	if r.Retry.MaxDelay > 0 {
+		p.MaxDelay = r.Retry.MaxDelay
+	}
+	if r.Retry.Jitter > 0 && r.Retry.Jitter <= 1 {
+		p.Jitter = r.Retry.Jitter
+	}
+	return p
+}
+
+// backoff is the delay after the given failed attempt, counting from 1
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.Delay * math.Pow(p.Multiplier, float64(attempt-1))
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d * float64(time.Second))
+}
+
+// permanentError is a failure retrying won't fix
+type permanentError struct {
+	error
+}
+
+// permanent reports whether retrying err is pointless, bad credentials,
+// unknown repositories and refs etc.
+func permanent(err error) bool {
+	if _, ok := err.(permanentError); ok {
+		return true
+	}
+	switch err {
+	case transport.ErrAuthenticationRequired,
+		transport.ErrAuthorizationFailed,
+		transport.ErrInvalidAuthMethod,
+		transport.ErrRepositoryNotFound,
+		transport.ErrEmptyRemoteRepository,
+		git.ErrRemoteNotFound,
+		git.ErrRepositoryAlreadyExists,
+		plumbing.ErrReferenceNotFound,
+		context.Canceled:
+		return true
+	}
+	// ssh handshake failures only come back as strings
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// do calls fn until it succeeds, fails permanently, runs out of attempts or
+// ctx is done, backing off between attempts. It returns the last error.
+func (p retryPolicy) do(ctx context.Context, rlog *logrus.Entry, what string, fn func() error) error {
+	var err error
+	for a := 1; ; a++ {
+		if p.Attempts > 1 {
+			rlog.Infof("%v attempt: %v", strings.Title(what), a)
+		}
+		err = fn()
+		recordAttempt(ctx, what, err)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			rlog.Warnf("%v cancelled", strings.Title(what))
+			return ctx.Err()
+		}
+		if permanent(err) {
+			rlog.Errorf("Failed to %v, not retrying: %v", what, err)
+			return err
+		}
+		if a >= p.Attempts {
+			rlog.Errorf("Failed to %v: %v", what, err)
+			if p.Attempts > 1 {
+				return fmt.Errorf("%v (after %v attempts)", err, a)
+			}
+			return err
+		}
+		delay := p.backoff(a)
+		rlog.Errorf("Failed to %v: %v, retrying in %v", what, err, delay.Round(time.Millisecond))
+		if !sleep(ctx, delay) {
+			return ctx.Err()
+		}
+	}
+}
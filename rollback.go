@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// pin holds a repo at a commit, webhook updates are held until it's removed
+type pin struct {
+	SHA  string    `json:"sha"`
+	Time time.Time `json:"time"`
+}
+
+func pinFile(path string) string {
+	return filepath.Join(conf().DataDir, "pins", stateName(path)+".json")
+}
+
+// pinned returns the repo's pin, if it has one
+func (r *repo) pinned() (pin, bool) {
+	var p pin
+	b, err := ioutil.ReadFile(pinFile(r.Path))
+	if err != nil {
+		return p, false
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		// still pinned, we just don't know where
+		log.WithField("repo", r.Name()).Errorf("Failed to read pin: %v", err)
+	}
+	return p, true
+}
+
+func (r *repo) pin(hash plumbing.Hash) error {
+	file := pinFile(r.Path)
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	b, err := json.Marshal(pin{SHA: hash.String(), Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0640)
+}
+
+func (r *repo) unpin() error {
+	if err := os.Remove(pinFile(r.Path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.WithField("repo", r.Name()).Warn("Repo unpinned, webhook updates will be applied again")
+	return nil
+}
+
+// rollbackTarget picks the commit to roll back to, either the deployed commit
+// matching to (full or abbreviated sha) or the one deployed steps before the
+// current HEAD.
+func (r *repo) rollbackTarget(head plumbing.Hash, to string, steps int) (plumbing.Hash, error) {
+	history, err := readHistory(r, 0)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read history: %v", err)
+	}
+
+	// known good commits, newest first, ignoring previous rollbacks so
+	// repeated rollbacks keep walking backwards
+	var good []string
+	seen := make(map[string]bool)
+	for _, d := range history {
+		if d.Type == "rollback" || d.NewSHA == "" || seen[d.NewSHA] {
+			continue
+		}
+		if d.Outcome == "succeeded" || d.Outcome == "recovered" {
+			good = append(good, d.NewSHA)
+			seen[d.NewSHA] = true
+		}
+	}
+
+	if !isEmpty(to) {
+		if len(to) == 40 {
+			return plumbing.NewHash(to), nil
+		}
+		for _, sha := range good {
+			if strings.HasPrefix(sha, to) {
+				return plumbing.NewHash(sha), nil
+			}
+		}
+		return plumbing.ZeroHash, fmt.Errorf("no previous deployment of %v, use the full sha", to)
+	}
+
+	pos := -1
+	for i, sha := range good {
+		if sha == head.String() {
+			pos = i
+			break
+		}
+	}
+	if pos+steps >= len(good) {
+		return plumbing.ZeroHash, fmt.Errorf("only %v earlier deployments in history", len(good)-pos-1)
+	}
+	return plumbing.NewHash(good[pos+steps]), nil
+}
+
+// rollback hard resets the repo to an earlier commit, fires the trigger and
+// pins the repo there.
+func (r *repo) rollback(j *job) (*deployment, error) {
+	rlog := log.WithFields(logrus.Fields{
+		"repo":      r.Name(),
+		"path":      r.Path,
+		"label":     r.Label,
+		"labelType": r.LabelType,
+	})
+
+	d := r.newDeployment(j)
+	defer d.save()
+
+	fail := func(err error) (*deployment, error) {
+		rlog.Errorf("Rollback failed: %v", err)
+		d.fail(err)
+		return d, err
+	}
+
+	repo, err := git.PlainOpen(r.Directory)
+	if err != nil {
+		return fail(fmt.Errorf("failed to open local git repository: %v", err))
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return fail(fmt.Errorf("failed to open work tree for repository: %v", err))
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fail(fmt.Errorf("failed to get local HEAD reference: %v", err))
+	}
+	d.OldSHA = head.Hash().String()
+
+	target, err := r.rollbackTarget(head.Hash(), j.to, j.steps)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := repo.CommitObject(target); err != nil {
+		return fail(fmt.Errorf("commit %v not found locally: %v", target, err))
+	}
+
+	rlog.Warnf("Rolling back from %v to %v", head.Hash(), target)
+	if err := w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: target}); err != nil {
+		return fail(fmt.Errorf("failed to hard reset work tree: %v", err))
+	}
+	if err := r.deploy(repo, target); err != nil {
+		return fail(err)
+	}
+	if err := r.pin(target); err != nil {
+		return fail(fmt.Errorf("rolled back but failed to pin, the next push will undo it: %v", err))
+	}
+	d.succeed(target)
+	rlog.Warnf("Rolled back to %v, repo pinned until unpinned", target)
+
+	if err := r.afterDeploy(j.ctx, d); err != nil {
+		d.fail(err)
+		return d, err
+	}
+	return d, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	dataDir := t.TempDir()
+	setConf(t, func(c *config) { c.DataDir = dataDir })
+
+	sha := func(c string) string { return strings.Repeat(c, 40) }
+	r := &repo{URL: "https://example.com/a/b.git", Path: "example.com/a/b"}
+	for _, d := range []deployment{
+		{Type: "clone", NewSHA: sha("a"), Outcome: "succeeded"},
+		{Type: "update", NewSHA: sha("b"), Outcome: "failed"},
+		{Type: "update", NewSHA: sha("c"), Outcome: "succeeded"},
+		{Type: "rollback", NewSHA: sha("a"), Outcome: "succeeded"},
+		{Type: "update", NewSHA: sha("d"), Outcome: "recovered"},
+		{Type: "update", NewSHA: sha("e"), Outcome: "skipped"},
+		{Type: "update", Outcome: "succeeded"},
+		{Type: "update", NewSHA: sha("f"), Outcome: "succeeded"},
+		{Type: "update", NewSHA: sha("f"), Outcome: "succeeded"},
+	} {
+		d := d
+		d.Repo, d.Path = r.Name(), r.Path
+		d.save()
+	}
+
+	// good deployments, newest first, are f d c a
+	for _, c := range []struct {
+		head, to string
+		steps    int
+		want     string // blank for an error
+	}{
+		{head: sha("f"), steps: 1, want: sha("d")},
+		{head: sha("f"), steps: 2, want: sha("c")},
+		{head: sha("f"), steps: 3, want: sha("a")},
+		{head: sha("f"), steps: 4},
+		{head: sha("d"), steps: 1, want: sha("c")},
+		{head: sha("c"), steps: 2},
+		// a head that was never deployed counts from the newest
+		{head: sha("9"), steps: 1, want: sha("f")},
+		{head: sha("f"), to: "ccc", want: sha("c")},
+		{head: sha("f"), to: "ddddddd", want: sha("d")},
+		{head: sha("f"), to: sha("9"), want: sha("9")},
+		// failed and skipped deployments aren't rollback targets
+		{head: sha("f"), to: "bbb"},
+		{head: sha("f"), to: "eee"},
+	} {
+		got, err := r.rollbackTarget(plumbing.NewHash(c.head), c.to, c.steps)
+		switch {
+		case c.want == "" && err == nil:
+			t.Errorf("head %.7v to %q steps %v: got %v, want an error", c.head, c.to, c.steps, got)
+		case c.want != "" && err != nil:
+			t.Errorf("head %.7v to %q steps %v: %v", c.head, c.to, c.steps, err)
+		case c.want != "" && got.String() != c.want:
+			t.Errorf("head %.7v to %q steps %v: got %v, want %v", c.head, c.to, c.steps, got, c.want)
+		}
+	}
+}
+
+func TestRollbackTargetNoHistory(t *testing.T) {
+	dataDir := t.TempDir()
+	setConf(t, func(c *config) { c.DataDir = dataDir })
+
+	r := &repo{URL: "https://example.com/a/b.git", Path: "example.com/a/b"}
+	if got, err := r.rollbackTarget(plumbing.NewHash(strings.Repeat("a", 40)), "", 1); err == nil {
+		t.Errorf("got %v without any history, want an error", got)
+	}
+}
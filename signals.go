@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// handleSignals shuts down gracefully on SIGINT / SIGTERM and reloads the
+// config on SIGHUP
+func handleSignals(srv *http.Server, passer *DataPasser) {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalCh {
+		if sig == syscall.SIGHUP {
+			log.Warn("SIGHUP received, reloading configuration...")
+			// a viper of our own, the config watcher may be reading the file into
+			// the global one at the same time
+			v := viper.New()
+			setDefaults(v)
+			v.SetConfigFile(viper.ConfigFileUsed())
+			if err := v.ReadInConfig(); err != nil {
+				log.Errorf("Failed to read config file, keeping the current configuration: %v", err)
+				continue
+			}
+			// reloading waits for running jobs, keep listening for signals meanwhile
+			go reloadConfig(passer, v)
+			continue
+		}
+		shutdown(srv)
+		os.Exit(0)
+	}
+}
+
+// abandonTimeout is how long shutdown waits for cancelled jobs to stop. Hard
+// resets, release exports and a rollback's post update steps don't stop
+// when cancelled, past this they're abandoned.
+const abandonTimeout = 10 * time.Second
+
+// shutdown stops accepting webhooks, then gives queued and running jobs up to
+// drain_timeout to finish. Anything left is cancelled, deliveries still in the
+// journal are replayed on the next start.
+func shutdown(srv *http.Server) {
+	log.Println("Signal received, preparing to shutting down...")
+	deadline := time.Now().Add(time.Duration(conf().DrainTimeout) * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("Failed to stop the http server cleanly: %v", err)
+	}
+
+	log.Warnf("Waiting up to %v for queued and running jobs to finish...", time.Until(deadline).Round(time.Second))
+	drained := make(chan struct{})
+	go func() {
+		sched.wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		// anything cancelled from here on is replayed on the next start
+		closeJournal()
+		if n := sched.cancelAll(); n > 0 {
+			log.Warnf("Drain timeout reached, cancelled %v clone / update jobs", n)
+		}
+		select {
+		case <-drained:
+		case <-time.After(abandonTimeout):
+			for _, rm := range sched.metrics().Repos {
+				log.WithFields(logrus.Fields{
+					"repo": rm.Repo,
+					"path": rm.Path,
+				}).Errorf("Job %v didn't stop within %v of being cancelled, abandoning it", rm.Running, abandonTimeout)
+			}
+		}
+	}
+	closeJournal()
+	log.Println("Shutting down GWG!")
+}
+
+// reloadConfig replaces the config with the one read into v, once running
+// jobs have finished
+func reloadConfig(passer *DataPasser, v *viper.Viper) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// create entirely new config, set defaults and publish it
+	// yaml and toml differences in repo mappings means we have to unmarshal
+	// everything first.
+	var newC config
+	if err := v.Unmarshal(&newC); err != nil {
+		log.Errorf("Failed to setup new configuration, keeping the current one: %v", err)
+		notifyReload(conf().Notifiers, err)
+		return
+	}
+
+	newC.DataPasser = passer
+	newC.refreshTasks()
+
+	// wait until repos are finished updating / cloning
+	log.Println("Waiting for repo updates to finish to safely update configuration...")
+	sched.wait()
+	log.Println("Replacing configuration...")
+	// jobs queued from here on see the new config
+	current.Store(&newC)
+	// clone new repos and move frozen ones to changed labels
+	newC.initialClone()
+	newC.startReconcilers()
+
+	log.Warn("Configuration updated")
+	notifyReload(newC.Notifiers, nil)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxTrackedJobs is how many jobs are remembered for the api, oldest go first
+const maxTrackedJobs = 1000
+
+// maxJobLog is the most log lines kept per job
+const maxJobLog = 1000
+
+// jobStatus is what the api shows for a job
+type jobStatus struct {
+	ID       string     `json:"id"`
+	Repo     string     `json:"repo"`
+	Path     string     `json:"path"`
+	Type     string     `json:"type"`
+	State    string     `json:"state"` // queued, running, succeeded, failed, rolled-back, skipped or cancelled
+	SHA      string     `json:"sha,omitempty"`
+	Delivery string     `json:"delivery,omitempty"`
+	Folded   []string   `json:"folded,omitempty"` // ids of later jobs folded into this one
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Reason   string     `json:"reason,omitempty"` // why a preUpdate command vetoed the job
+	Log      []string   `json:"log,omitempty"`
+}
+
+// tracker remembers jobs by id, folded jobs map to the job they were folded
+// into. Don't log while holding it, the log hook takes it too.
+var tracker = struct {
+	sync.Mutex
+	jobs    map[string]*job
+	order   []string        // ids, oldest first
+	running map[string]*job // by repo path
+}{
+	jobs:    make(map[string]*job),
+	running: make(map[string]*job),
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newJob creates a queued job and starts tracking it
+func newJob(r *repo, jobType string) *job {
+	return trackJob(&job{
+		id:      newJobID(),
+		repo:    r,
+		jobType: jobType,
+	})
+}
+
+// trackJob starts tracking j as queued
+func trackJob(j *job) *job {
+	j.status = jobStatus{
+		ID:     j.id,
+		Repo:   j.repo.Name(),
+		Path:   j.repo.Path,
+		Type:   j.jobType,
+		State:  "queued",
+		Queued: time.Now(),
+	}
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	tracker.jobs[j.id] = j
+	tracker.order = append(tracker.order, j.id)
+	for len(tracker.order) > maxTrackedJobs {
+		delete(tracker.jobs, tracker.order[0])
+		tracker.order = tracker.order[1:]
+	}
+	return j
+}
+
+// started marks the job as running, its log lines are captured from now on
+func (j *job) started() {
+	now := time.Now()
+	tracker.Lock()
+	j.status.State = "running"
+	j.status.Type = j.jobType
+	j.status.SHA = j.sha
+	j.status.Delivery = j.delivery
+	j.status.Started = &now
+	tracker.running[j.repo.Path] = j
+	tracker.Unlock()
+}
+
+// foldedInto records that j was folded into p, j's id now refers to p
+func (j *job) foldedInto(p *job) {
+	tracker.Lock()
+	p.status.Type = p.jobType
+	p.status.SHA = p.sha
+	p.status.Delivery = p.delivery
+	p.status.Folded = append(p.status.Folded, j.id)
+	tracker.jobs[j.id] = p
+	tracker.Unlock()
+}
+
+// lookupJob returns the status of a job, or the job it was folded into
+func lookupJob(id string) (jobStatus, bool) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	j, ok := tracker.jobs[id]
+	if !ok {
+		return jobStatus{}, false
+	}
+	s := j.status
+	s.Log = append([]string(nil), j.status.Log...)
+	s.Folded = append([]string(nil), j.status.Folded...)
+	return s, true
+}
+
+// listJobs returns the tracked jobs newest first, without their logs,
+// optionally filtered by repo path and state
+func listJobs(path, state string) []jobStatus {
+	tracker.Lock()
+	defer tracker.Unlock()
+	list := []jobStatus{}
+	for i := len(tracker.order) - 1; i >= 0; i-- {
+		id := tracker.order[i]
+		j := tracker.jobs[id]
+		// skip ids that were folded into another job
+		if j.id != id {
+			continue
+		}
+		if (path != "" && j.status.Path != path) || (state != "" && j.status.State != state) {
+			continue
+		}
+		s := j.status
+		s.Log = nil
+		s.Folded = append([]string(nil), j.status.Folded...)
+		list = append(list, s)
+	}
+	return list
+}
+
+// jobLogHook captures log lines into the log of the job running for the
+// repo, a repo only ever runs one job at a time.
+type jobLogHook struct {
+	formatter logrus.Formatter
+}
+
+func (h jobLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h jobLogHook) Fire(e *logrus.Entry) error {
+	path, ok := e.Data["path"].(string)
+	if !ok {
+		return nil
+	}
+	line, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	if j, ok := tracker.running[path]; ok && len(j.status.Log) < maxJobLog {
+		j.status.Log = append(j.status.Log, strings.TrimSpace(string(line)))
+	}
+	return nil
+}
+
+func init() {
+	log.AddHook(jobLogHook{formatter: &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}})
+}
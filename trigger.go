@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// triggerPayload is written to the trigger file with triggerFormat json or env
+type triggerPayload struct {
+	Repo      string    `json:"repo"`
+	Path      string    `json:"path"`
+	Directory string    `json:"directory"`
+	Type      string    `json:"type"`
+	Ref       string    `json:"ref"`
+	OldSHA    string    `json:"oldSha"`
+	NewSHA    string    `json:"newSha"`
+	Delivery  string    `json:"delivery"`
+	Pusher    string    `json:"pusher"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (c *config) validateTriggerFormat() {
+	for i := range c.Repos {
+		switch c.Repos[i].TriggerFormat {
+		case "touch", "json", "env", "":
+		default:
+			log.Warnf("Unknown trigger format for repo: %s, defaulting to touch", c.Repos[i].Name())
+			c.Repos[i].TriggerFormat = "touch"
+		}
+	}
+}
+
+// touchTrigger fires the trigger for d, either touching the file or
+// replacing it with the deployment's details
+func (r *repo) touchTrigger(d *deployment) error {
+	if !r.HasTrigger() {
+		return nil
+	}
+	rlog := log.WithFields(logrus.Fields{
+		"repo":      r.Name(),
+		"path":      r.Path,
+		"label":     r.Label,
+		"labelType": r.LabelType,
+		"trigger":   r.Trigger,
+	})
+
+	if err := os.MkdirAll(filepath.Dir(r.Trigger), 0750); err != nil {
+		rlog.Errorf("Failed to create trigger file directory: %v", err)
+		return fmt.Errorf("failed to create trigger file directory: %v", err)
+	}
+
+	var err error
+	switch r.TriggerFormat {
+	case "json", "env":
+		err = r.writeTrigger(d)
+	default:
+		err = touch(r.Trigger)
+	}
+	if err != nil {
+		rlog.Errorf("Failed to update trigger file: %v", err)
+		return fmt.Errorf("failed to update trigger file: %v", err)
+	}
+	rlog.Info("Successfully updated trigger file")
+	return nil
+}
+
+// touch updates the file's times, creating it if it doesn't exist
+func touch(file string) error {
+	now := time.Now()
+	err := os.Chtimes(file, now, now)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeTrigger replaces the trigger file with d's details. The payload is
+// written to a temporary file next to it and renamed over it, so watchers
+// only ever see a complete file.
+func (r *repo) writeTrigger(d *deployment) error {
+	p := triggerPayload{
+		Repo:      r.Name(),
+		Path:      r.Path,
+		Directory: r.deployedDir(),
+		Type:      d.Type,
+		Ref:       d.Ref,
+		OldSHA:    d.OldSHA,
+		NewSHA:    d.NewSHA,
+		Delivery:  d.Delivery,
+		Pusher:    d.Pusher,
+		Timestamp: time.Now(),
+	}
+	var b []byte
+	if r.TriggerFormat == "json" {
+		var err error
+		if b, err = json.MarshalIndent(p, "", "  "); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	} else {
+		b = p.env()
+	}
+
+	dir, name := filepath.Split(r.Trigger)
+	f, err := ioutil.TempFile(dir, "."+name+".gwg-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	// TempFile creates the file 0600, keep the trigger readable by its watchers
+	if err = f.Chmod(0660); err == nil {
+		if _, err = f.Write(b); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, r.Trigger)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// env renders the payload as shell / systemd EnvironmentFile assignments,
+// using the same names as the post update commands' environment
+func (p triggerPayload) env() []byte {
+	var b bytes.Buffer
+	for _, kv := range [][2]string{
+		{"GWG_REPO", p.Repo},
+		{"GWG_PATH", p.Path},
+		{"GWG_DIRECTORY", p.Directory},
+		{"GWG_TYPE", p.Type},
+		{"GWG_REF", p.Ref},
+		{"GWG_OLD_SHA", p.OldSHA},
+		{"GWG_NEW_SHA", p.NewSHA},
+		{"GWG_DELIVERY", p.Delivery},
+		{"GWG_PUSHER", p.Pusher},
+		{"GWG_TIMESTAMP", p.Timestamp.Format(time.RFC3339)},
+	} {
+		// single quoted, with any single quotes closed, escaped and reopened
+		fmt.Fprintf(&b, "%v='%v'\n", kv[0], strings.Replace(kv[1], "'", `'\''`, -1))
+	}
+	return b.Bytes()
+}